@@ -8,6 +8,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/ssb-ngi-pointer/netsim/internal/keys"
 	"go.cryptoscope.co/muxrpc/v2"
@@ -15,7 +16,40 @@ import (
 	"go.cryptoscope.co/secretstream"
 )
 
-func NewTCP(port int, capsKey, secretPath string) (muxrpc.Endpoint, error) {
+// Conn is a muxrpc endpoint that keeps track of whether its underlying connection is still being served, so that it
+// can be reused across many requests and replaced once it has died.
+type Conn struct {
+	muxrpc.Endpoint
+	// Handshake is the time it took to dial, perform the secret handshake and set up the boxstream
+	Handshake time.Duration
+
+	done chan struct{}
+	err  error
+}
+
+// Done is closed once the muxrpc session has stopped being served, e.g. because the remote sbot went away
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the error that stopped the muxrpc session, if any. Only valid after Done has been closed.
+func (c *Conn) Err() error {
+	return c.err
+}
+
+// Alive reports whether the muxrpc session is still being served
+func (c *Conn) Alive() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Dial establishes a long-lived muxrpc session with the sbot listening on port
+func Dial(port int, capsKey, secretPath string) (*Conn, error) {
+	start := time.Now()
 	kp, err := keys.LoadKeyPair(secretPath)
 	if err != nil {
 		return nil, err
@@ -47,14 +81,21 @@ func NewTCP(port int, capsKey, secretPath string) (muxrpc.Endpoint, error) {
 	var muxMock = new(muxrpc.FakeHandler)
 	muxClient := muxrpc.Handle(muxrpc.NewPacker(authedConn), muxMock)
 
-	// TODO: how to waitgroups
+	c := &Conn{Endpoint: muxClient, Handshake: time.Since(start), done: make(chan struct{})}
 	go func() {
 		srv := muxClient.(muxrpc.Server)
-		err = srv.Serve()
-		if err != nil {
-			fmt.Printf("mux client(%d) error: %v\n", port, err)
-		}
+		c.err = srv.Serve()
+		close(c.done)
 	}()
 
-	return muxClient, nil
+	return c, nil
+}
+
+// NewTCP opens a muxrpc session for a single use. Prefer Dial when issuing many requests against the same sbot.
+func NewTCP(port int, capsKey, secretPath string) (muxrpc.Endpoint, error) {
+	c, err := Dial(port, capsKey, secretPath)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
 }
@@ -20,6 +20,7 @@ func main() {
 	var expectationsArgs expectations.Args
 	flag.StringVar(&args.FixturesRoot, "fixtures", "./fixtures-output", "root folder containing spliced out ssb-fixtures")
 	flag.StringVar(&args.SSBServer, "sbot", "ssb-server", "the ssb server to start puppets with")
+	flag.IntVar(&args.Roles, "roles", 0, "optional: start the puppets with this many implementation roles ($IMPL_A, $IMPL_B..) in turn, instead of --sbot")
 	flag.IntVar(&args.MaxHops, "hops", 2, "the max hops count to use")
 	flag.BoolVar(&expectationsArgs.ReplicateBlocked, "replicate-blocked", false, "if flag is present, blocked peers will be replicated")
 	flag.IntVar(&args.FocusedCount, "focused", 2, "number of puppets to use for focus group (i.e. # of puppets that verify they are replicating others)")
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/ssb-ngi-pointer/netsim/expectations"
@@ -17,7 +18,7 @@ import (
 )
 
 func usageExit() {
-	fmt.Println("Usage: netsim [generate, run] <flags>")
+	fmt.Println("Usage: netsim [generate, run, lint, doctor, minimize, repl] <flags>")
 	os.Exit(1)
 }
 
@@ -48,10 +49,12 @@ func main() {
 		var focusedPuppets int
 		var onlySplice bool
 		var generationSeed int64
+		var roles int
 		flag.BoolVar(&onlySplice, "no-test-script", false, "only converts the input fixtures to netsim-style fixtures")
 		flag.BoolVar(&replicateBlocked, "replicate-blocked", false, "if flag is present, blocked peers will be replicated")
 		flag.StringVar(&outpath, "out", "./", "the output path of the generated netsim test & its auxiliary files")
 		flag.StringVar(&ssbServer, "sbot", "ssb-server", "the ssb server to start puppets with")
+		flag.IntVar(&roles, "roles", 0, "optional: start the puppets with this many implementation roles ($IMPL_A, $IMPL_B..) in turn, instead of --sbot")
 		flag.IntVar(&focusedPuppets, "focused", 2, "number of puppets that verify they are fully replicating their hops")
 		flag.Int64Var(&generationSeed, "seed", 0, "seed used by test generation")
 		flag.Parse()
@@ -74,7 +77,7 @@ func main() {
 		// use the spliced logs to generate expectations
 		expectations := generateExpectations(fixturesOutput, hops, replicateBlocked)
 		// use the generated expectations & generate the test
-		generatedTest := generateTest(fixturesOutput, ssbServer, focusedPuppets, hops, generationSeed, expectations)
+		generatedTest := generateTest(fixturesOutput, ssbServer, roles, focusedPuppets, hops, generationSeed, expectations)
 		// echo
 		fmt.Println(generatedTest)
 		// save test file to disk
@@ -84,15 +87,27 @@ func main() {
 		}
 	case "run":
 		var simArgs sim.Args
+		var matrix bool
+		var repeat int
 		flag.StringVar(&simArgs.Caps, "caps", sim.DefaultShsCaps, "the secret handshake capability key")
 		flag.StringVar(&fixturesDir, "fixtures", "", "optional: path to the output of a ssb-fixtures run, if using")
 		flag.StringVar(&simArgs.Outdir, "out", "./puppets", "the output directory containing instantiated netsim peers")
 		flag.IntVar(&simArgs.BasePort, "port", 18888, "start of port range used for each running sbot")
+		flag.StringVar(&simArgs.IdentitySeed, "identity-seed", "", "optional: derive the identities of puppets not loaded from --fixtures from this seed, so that their feed ids are the same in every run")
+		flag.StringVar(&simArgs.SnapshotDir, "snapshots", "./snapshots", "the directory where the snapshots taken by the snapshot command are kept")
+		flag.StringVar(&simArgs.FromSnapshot, "from-snapshot", "", "optional: restore the puppets of this snapshot before running the first statement")
 		flag.BoolVar(&simArgs.Verbose, "v", false, "increase logging verbosity")
+		flag.StringVar(&simArgs.Report, "report", "", "optional: write a machine-readable json report of the run to this path")
+		flag.StringVar(&simArgs.Format, "format", sim.FormatTAP, "output format of the results: tap or junit")
+		flag.DurationVar(&simArgs.SampleInterval, "sample-interval", 0, "optional: sample the messages, feeds & resource usage of running puppets at this interval (e.g. 1s)")
+		flag.StringVar(&simArgs.Samples, "samples", "", "path of the samples file; csv, or ndjson if named .ndjson or .jsonl (default: samples.csv in --out)")
+		flag.IntVar(&repeat, "repeat", 0, "optional: run the test this many times, and report how often each statement passed & how long it took")
+		flag.BoolVar(&matrix, "matrix", false, "run the test once for every assignment of the passed sbots to its implementation roles ($IMPL_A, $IMPL_B..)")
 		flag.Parse()
 
 		checkVersionFlag(versionFlag)
 
+		simArgs.Version = version
 		simArgs.Hops = hops
 		simArgs.Testfile = testfile
 		simArgs.FixturesDir = fixturesDir
@@ -102,7 +117,114 @@ func main() {
 				"path-to-sbot1 path-to-sbot2.. path-to-sbotn",
 				"Run a simulation with the passed-in sbots and a netsim test")
 		}
-		sim.Run(simArgs, flag.Args())
+		switch {
+		case matrix && repeat > 0:
+			errOut("netsim run", errors.New("--matrix and --repeat can't be combined"))
+		case matrix:
+			sim.RunMatrix(simArgs, flag.Args())
+		case repeat > 0:
+			sim.RunRepeatedly(simArgs, flag.Args(), repeat)
+		default:
+			sim.Run(simArgs, flag.Args())
+		}
+	case "lint":
+		var simArgs sim.Args
+		flag.StringVar(&fixturesDir, "fixtures", "", "optional: path to the output of a ssb-fixtures run, if using")
+		flag.StringVar(&simArgs.SnapshotDir, "snapshots", "./snapshots", "the directory where the snapshots taken by the snapshot command are kept")
+		flag.StringVar(&simArgs.FromSnapshot, "from-snapshot", "", "optional: restore the puppets of this snapshot before running the first statement")
+		flag.Parse()
+
+		checkVersionFlag(versionFlag)
+
+		simArgs.Testfile = testfile
+		simArgs.FixturesDir = fixturesDir
+		// the sbots are optional when linting; if none are passed, the implementations used by `start` aren't checked
+		problems := sim.Lint(simArgs, flag.Args())
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			fmt.Fprintf(os.Stderr, "netsim lint: found %d problems in %s\n", len(problems), testfile)
+			os.Exit(1)
+		}
+	case "minimize":
+		var simArgs sim.Args
+		var minimized string
+		var maxRuns int
+		flag.StringVar(&simArgs.Caps, "caps", sim.DefaultShsCaps, "the secret handshake capability key")
+		flag.StringVar(&fixturesDir, "fixtures", "", "optional: path to the output of a ssb-fixtures run, if using")
+		flag.StringVar(&simArgs.Outdir, "out", "./puppets", "the output directory containing instantiated netsim peers")
+		flag.IntVar(&simArgs.BasePort, "port", 18888, "start of port range used for each running sbot")
+		flag.StringVar(&simArgs.IdentitySeed, "identity-seed", "", "optional: derive the identities of puppets not loaded from --fixtures from this seed, so that their feed ids are the same in every run")
+		flag.StringVar(&simArgs.SnapshotDir, "snapshots", "./snapshots", "the directory where the snapshots taken by the snapshot command are kept")
+		flag.StringVar(&simArgs.FromSnapshot, "from-snapshot", "", "optional: restore the puppets of this snapshot before running the first statement")
+		flag.BoolVar(&simArgs.Verbose, "v", false, "increase logging verbosity")
+		flag.StringVar(&minimized, "minimized", "", "path of the minimized test (default: the --spec path, suffixed with -min)")
+		flag.IntVar(&maxRuns, "max-runs", 0, "optional: stop after running this many variants of the test")
+		flag.Parse()
+
+		checkVersionFlag(versionFlag)
+
+		simArgs.Version = version
+		simArgs.Hops = hops
+		simArgs.Testfile = testfile
+		simArgs.FixturesDir = fixturesDir
+		if minimized == "" {
+			ext := path.Ext(testfile)
+			minimized = strings.TrimSuffix(testfile, ext) + "-min" + ext
+		}
+
+		if len(flag.Args()) == 0 {
+			printHelp("minimize",
+				"path-to-sbot1 path-to-sbot2.. path-to-sbotn",
+				"Find the smallest variant of a failing netsim test that still fails on the same statement")
+		}
+		err := sim.Minimize(simArgs, flag.Args(), minimized, maxRuns)
+		errOut("netsim minimize", err)
+	case "repl":
+		var simArgs sim.Args
+		flag.StringVar(&simArgs.Caps, "caps", sim.DefaultShsCaps, "the secret handshake capability key")
+		flag.StringVar(&fixturesDir, "fixtures", "", "optional: path to the output of a ssb-fixtures run, if using")
+		flag.StringVar(&simArgs.Outdir, "out", "./puppets", "the output directory containing instantiated netsim peers")
+		flag.IntVar(&simArgs.BasePort, "port", 18888, "start of port range used for each running sbot")
+		flag.StringVar(&simArgs.IdentitySeed, "identity-seed", "", "optional: derive the identities of puppets not loaded from --fixtures from this seed, so that their feed ids are the same in every run")
+		flag.StringVar(&simArgs.SnapshotDir, "snapshots", "./snapshots", "the directory where the snapshots taken by the snapshot command are kept")
+		flag.StringVar(&simArgs.FromSnapshot, "from-snapshot", "", "optional: restore the puppets of this snapshot before running the first statement")
+		flag.Parse()
+
+		checkVersionFlag(versionFlag)
+
+		simArgs.Version = version
+		simArgs.Hops = hops
+		simArgs.FixturesDir = fixturesDir
+
+		if len(flag.Args()) == 0 {
+			printHelp("repl",
+				"path-to-sbot1 path-to-sbot2.. path-to-sbotn",
+				"Start the sbots' puppets one statement at a time, entered interactively or piped in on stdin")
+		}
+		err := sim.Repl(simArgs, flag.Args())
+		errOut("netsim repl", err)
+	case "doctor":
+		var simArgs sim.Args
+		flag.StringVar(&simArgs.Caps, "caps", sim.DefaultShsCaps, "the secret handshake capability key")
+		flag.IntVar(&simArgs.BasePort, "port", 18888, "start of the port range searched for a free pair of ports for the sbot being checked")
+		flag.BoolVar(&simArgs.Verbose, "v", false, "increase logging verbosity")
+		flag.Parse()
+
+		checkVersionFlag(versionFlag)
+
+		simArgs.Hops = hops
+		if len(flag.Args()) != 1 {
+			printHelp("doctor",
+				"path-to-sbot",
+				"Check which of the muxrpc calls used by netsim an sbot implements")
+		}
+		problems := sim.Doctor(simArgs, flag.Args()[0])
+		if problems > 0 {
+			fmt.Fprintf(os.Stderr, "netsim doctor: found %d problems with %s\n", problems, flag.Args()[0])
+			os.Exit(1)
+		}
 	default:
 		usageExit()
 	}
@@ -133,10 +255,11 @@ func printHelp(cmd, usage, description string) {
 	os.Exit(1)
 }
 
-func generateTest(fixturesRoot, sbot string, focused, hops int, seed int64, expectations map[string][]string) string {
+func generateTest(fixturesRoot, sbot string, roles, focused, hops int, seed int64, expectations map[string][]string) string {
 	var generationArgs generation.Args
 	generationArgs.FixturesRoot = fixturesRoot
 	generationArgs.SSBServer = sbot
+	generationArgs.Roles = roles
 	generationArgs.MaxHops = hops
 	generationArgs.Seed = seed
 	generationArgs.FocusedCount = focused
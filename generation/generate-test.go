@@ -17,8 +17,14 @@ import (
 	"sort"
 )
 
+// maxRoles is the number of implementation roles that can be named, $IMPL_A to $IMPL_Z
+const maxRoles = 26
+
 type Args struct {
-	SSBServer    string
+	SSBServer string
+	// if set, puppets are started with the implementation roles $IMPL_A, $IMPL_B.. in turn instead of SSBServer, so that
+	// the test can be run against other implementations with `netsim run --matrix`
+	Roles        int
 	FixturesRoot string
 	FocusedCount int
 	MaxHops      int
@@ -32,6 +38,7 @@ type Generator struct {
 	NamesToIDs         map[string]string
 	currentlyExecuting map[string]bool
 	isBlocking         map[string]map[string]bool
+	implementations    map[string]string // the implementation each puppet is started with, when using roles
 	Args               Args
 
 	Output io.Writer
@@ -139,9 +146,13 @@ func (g Generator) GetIDs(src []string) []string {
 }
 
 func GenerateTest(args Args, expectations map[string][]string, outputWriter io.Writer) {
+	if args.Roles > maxRoles {
+		check(fmt.Errorf("--roles %d: at most %d roles ($IMPL_A to $IMPL_Z) are supported", args.Roles, maxRoles))
+	}
 	g := Generator{
 		Args:               args,
 		currentlyExecuting: make(map[string]bool),
+		implementations:    make(map[string]string),
 		Output:             outputWriter,
 	}
 
@@ -240,6 +251,8 @@ func GenerateTest(args Args, expectations map[string][]string, outputWriter io.W
 	for _, name := range g.FocusGroup {
 		focusedId := g.NamesToIDs[name]
 		g.has(name, g.getNames(expectations[focusedId]))
+		// assert that the feeds blocked by the focused puppet were not replicated (unless they are expected to be)
+		g.hasNot(name, g.getNames(g.unexpectedBlocks(focusedId, expectations[focusedId])))
 	}
 
 	g.stop(g.FocusGroup)
@@ -266,6 +279,31 @@ func (g Generator) has(issuer string, names []string) {
 	}
 }
 
+// hasNot asserts that issuer has not stored any messages of the passed in puppets
+func (g Generator) hasNot(issuer string, names []string) {
+	for _, name := range names {
+		fmt.Fprintf(g.Output, "has %s %s@0\n", issuer, name)
+	}
+}
+
+// unexpectedBlocks returns the ids blocked by id which are not part of id's replication expectations, sorted
+func (g Generator) unexpectedBlocks(id string, expected []string) []string {
+	isExpected := make(map[string]bool)
+	for _, expectedId := range expected {
+		isExpected[expectedId] = true
+	}
+	var blocked []string
+	for blockedId := range g.isBlocking[id] {
+		// only assert on blocked feeds that are part of the simulation
+		if _, exists := g.IDsToNames[blockedId]; !exists || isExpected[blockedId] {
+			continue
+		}
+		blocked = append(blocked, blockedId)
+	}
+	sort.Strings(blocked)
+	return blocked
+}
+
 func (g Generator) disconnect(issuer string, names []string) {
 	for _, name := range names {
 		fmt.Fprintf(g.Output, "disconnect %s %s\n", issuer, name)
@@ -281,12 +319,26 @@ func (g Generator) connect(issuer string, names []string) {
 func (g Generator) start(names []string) {
 	for _, name := range names {
 		if _, exists := g.currentlyExecuting[name]; !exists {
-			fmt.Fprintf(g.Output, "start %s %s\n", name, g.Args.SSBServer)
+			fmt.Fprintf(g.Output, "start %s %s\n", name, g.implementation(name))
 			g.currentlyExecuting[name] = true
 		}
 	}
 }
 
+// implementation returns what name is started with. with roles, each puppet keeps the role it was first started with,
+// and the roles are handed out in turn
+func (g Generator) implementation(name string) string {
+	if g.Args.Roles <= 0 {
+		return g.Args.SSBServer
+	}
+	if impl, exists := g.implementations[name]; exists {
+		return impl
+	}
+	impl := fmt.Sprintf("$IMPL_%c", 'A'+len(g.implementations)%g.Args.Roles)
+	g.implementations[name] = impl
+	return impl
+}
+
 func (g Generator) stop(names []string) {
 	for _, name := range names {
 		var skip bool
@@ -16,4 +16,5 @@ require (
 	go.cryptoscope.co/secretstream v1.2.9
 	go.mindeco.de/ssb-refs v0.4.2-0.20210908123826-f7ca13c14896
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+	golang.org/x/term v0.0.0-20201210144234-2321bbc49cbf
 )
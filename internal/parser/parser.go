@@ -4,39 +4,298 @@
 
 // Package parser parses the lisp-like syntax for defining custom SSB messages, written in combination with the
 // `publish` command.
+//
+// A message is written as a list of (key value) pairs, where dotted keys create nested objects:
+//
+//	(type post) (text "hello, world") (value.count 3) (value.ok true) (mentions [alice "bob c"])
+//
+// Values are numbers, true, false, null, "quoted strings" (with json escapes), [arrays of values] or bare text, which
+// runs until the closing parenthesis. Alternatively, the whole message may be written as a json object:
+//
+//	{"type": "vote", "vote": {"link": "%...", "value": 1}}
 package parser
 
 import (
-	"regexp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
 	"strings"
 )
 
-// matches (type post) (value.content hello) (channel ssb-help)
-var postPattern = regexp.MustCompile(`\((\S+)\s([^()]+?)\)`)
+// Error is a syntax error, pointing at the column of the line where it was found
+type Error struct {
+	Column int // 1-based
+	Msg    string
+}
+
+func (e Error) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Column, e.Msg)
+}
+
+// Parse parses a message written in the (key value) syntax, or as a json object
+func Parse(line string) (map[string]interface{}, error) {
+	trimmed := strings.TrimSpace(line)
+	if strings.HasPrefix(trimmed, "{") {
+		return parseJSON(line)
+	}
+	s := scanner{src: line}
+	msg := make(map[string]interface{})
+	for {
+		s.skipSpace()
+		if s.done() {
+			return msg, nil
+		}
+		if err := s.pair(msg); err != nil {
+			return nil, err
+		}
+	}
+}
 
-/* TODO:
-* implement number parsing (strconv attempt), boolean parsing (if true|false => bool it up)
- */
+// ParsePostLine parses a message, returning an empty message if it contained errors.
+//
+// Deprecated: use Parse, which reports the errors.
 func ParsePostLine(line string) map[string]interface{} {
-	matched := postPattern.FindAllStringSubmatch(line, -1)
-	postMap := make(map[string]interface{})
-
-	for _, match := range matched {
-		key, content := match[1], match[2]
-		// post contains a nested key value, e.g. (value.content hello) => should produce json { "value": { "content": "hello" } }
-		if strings.ContainsAny(key, ".") {
-			keys := strings.Split(key, ".")
-			m := postMap
-			for _, keyPart := range keys[:len(keys)-1] {
-				m[keyPart] = make(map[string]interface{})
-				m = m[keyPart].(map[string]interface{})
+	msg, err := Parse(line)
+	if err != nil {
+		return map[string]interface{}{}
+	}
+	return msg
+}
+
+func parseJSON(line string) (map[string]interface{}, error) {
+	var msg map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(line))
+	err := dec.Decode(&msg)
+	if err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			return nil, Error{Column: int(syntaxErr.Offset), Msg: syntaxErr.Error()}
+		case errors.As(err, &typeErr):
+			return nil, Error{Column: int(typeErr.Offset), Msg: "the message should be a json object"}
+		}
+		return nil, Error{Column: len(line), Msg: err.Error()}
+	}
+	// nothing but whitespace may follow the object
+	offset := int(dec.InputOffset())
+	rest := line[offset:]
+	if trimmed := strings.TrimLeft(rest, " \t"); trimmed != "" {
+		return nil, Error{Column: offset + len(rest) - len(trimmed) + 1, Msg: "unexpected text after the json object"}
+	}
+	return msg, nil
+}
+
+type scanner struct {
+	src string
+	pos int
+}
+
+func (s *scanner) done() bool {
+	return s.pos >= len(s.src)
+}
+
+func (s *scanner) peek() byte {
+	return s.src[s.pos]
+}
+
+func (s *scanner) skipSpace() {
+	for !s.done() && (s.peek() == ' ' || s.peek() == '\t') {
+		s.pos++
+	}
+}
+
+func (s *scanner) errorf(pos int, format string, a ...interface{}) error {
+	return Error{Column: pos + 1, Msg: fmt.Sprintf(format, a...)}
+}
+
+// pair parses a (key value) pair, and sets it in msg
+func (s *scanner) pair(msg map[string]interface{}) error {
+	if s.peek() != '(' {
+		return s.errorf(s.pos, "expected ( to start a (key value) pair, found %q", s.peek())
+	}
+	start := s.pos
+	s.pos++
+	s.skipSpace()
+	keyStart := s.pos
+	for !s.done() && !strings.ContainsRune(" \t()", rune(s.peek())) {
+		s.pos++
+	}
+	key := s.src[keyStart:s.pos]
+	if key == "" {
+		return s.errorf(keyStart, "expected a key")
+	}
+	s.skipSpace()
+	if s.done() || s.peek() == ')' {
+		return s.errorf(s.pos, "key %s is missing its value", key)
+	}
+	value, err := s.value(true)
+	if err != nil {
+		return err
+	}
+	s.skipSpace()
+	if s.done() {
+		return s.errorf(start, "( is missing its closing )")
+	}
+	if s.peek() != ')' {
+		return s.errorf(s.pos, "expected ) after the value of %s, found %q", key, s.peek())
+	}
+	s.pos++
+	return set(msg, key, value, func(msg string) error { return s.errorf(keyStart, "%s", msg) })
+}
+
+// value parses a single value. bare text, which runs until the closing parenthesis, is only allowed at the top level
+// of a pair
+func (s *scanner) value(top bool) (interface{}, error) {
+	switch s.peek() {
+	case '"':
+		return s.quoted()
+	case '[':
+		return s.array()
+	case '{':
+		return s.object()
+	case '(':
+		return nil, s.errorf(s.pos, "unexpected (; quote values containing parentheses")
+	}
+
+	start := s.pos
+	if top {
+		// bare text, which may contain spaces. a single word is interpreted as a number, boolean or null if it is one
+		for !s.done() && s.peek() != ')' {
+			if s.peek() == '(' || s.peek() == '"' {
+				return nil, s.errorf(s.pos, "unexpected %c in unquoted text; quote values containing it", s.peek())
 			}
-			m[keys[len(keys)-1]] = content
-		} else {
-			// this group contained a regular key:value mapping (type post) => { "type": "post" }
-			postMap[key] = content
+			s.pos++
 		}
+		text := strings.TrimRight(s.src[start:s.pos], " \t")
+		s.pos = start + len(text)
+		if strings.ContainsAny(text, " \t") {
+			return text, nil
+		}
+		return literal(text), nil
+	}
+
+	for !s.done() && !strings.ContainsRune(" \t,[]()\"", rune(s.peek())) {
+		s.pos++
+	}
+	return literal(s.src[start:s.pos]), nil
+}
+
+// literal interprets a word as a number, boolean or null, falling back to the word itself
+func literal(word string) interface{} {
+	switch word {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "null":
+		return nil
+	}
+	if n, err := strconv.ParseFloat(word, 64); err == nil && isNumber(word) {
+		return n
 	}
+	return word
+}
+
+// isNumber reports whether word is written as a json number, so that e.g. Inf or 0x10 stay text
+func isNumber(word string) bool {
+	var n json.Number
+	return json.Unmarshal([]byte(word), &n) == nil
+}
 
-	return postMap
+// quoted parses a string in double quotes, with json escapes
+func (s *scanner) quoted() (string, error) {
+	start := s.pos
+	s.pos++
+	for !s.done() && s.peek() != '"' {
+		if s.peek() == '\\' {
+			s.pos++
+		}
+		s.pos++
+	}
+	if s.done() {
+		return "", s.errorf(start, "string is missing its closing quote")
+	}
+	s.pos++
+	var str string
+	if err := json.Unmarshal([]byte(s.src[start:s.pos]), &str); err != nil {
+		return "", s.errorf(start, "invalid string %s", s.src[start:s.pos])
+	}
+	return str, nil
+}
+
+// array parses [value value ...]; the values may also be separated by commas
+func (s *scanner) array() ([]interface{}, error) {
+	start := s.pos
+	s.pos++
+	values := []interface{}{}
+	for {
+		for !s.done() && strings.ContainsRune(" \t,", rune(s.peek())) {
+			s.pos++
+		}
+		if s.done() {
+			return nil, s.errorf(start, "[ is missing its closing ]")
+		}
+		if s.peek() == ']' {
+			s.pos++
+			return values, nil
+		}
+		if s.peek() == ')' {
+			return nil, s.errorf(s.pos, "unexpected ) inside of [ ]")
+		}
+		value, err := s.value(false)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+}
+
+// object parses a json object nested as a value, e.g. (value {"a": 1})
+func (s *scanner) object() (interface{}, error) {
+	start := s.pos
+	dec := json.NewDecoder(strings.NewReader(s.src[start:]))
+	var obj map[string]interface{}
+	if err := dec.Decode(&obj); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return nil, s.errorf(start+int(syntaxErr.Offset)-1, "%s", syntaxErr.Error())
+		}
+		return nil, s.errorf(start, "invalid json object (%s)", err)
+	}
+	s.pos = start + int(dec.InputOffset())
+	return obj, nil
+}
+
+// set sets the (possibly dotted) key of msg to value, creating nested objects along the way, and merging into those
+// that already exist
+func set(msg map[string]interface{}, key string, value interface{}, fail func(string) error) error {
+	parts := strings.Split(key, ".")
+	for _, part := range parts {
+		if part == "" {
+			return fail(fmt.Sprintf("key %s has an empty part", key))
+		}
+	}
+	m := msg
+	for i, part := range parts[:len(parts)-1] {
+		existing, ok := m[part]
+		if !ok {
+			nested := make(map[string]interface{})
+			m[part] = nested
+			m = nested
+			continue
+		}
+		nested, isObject := existing.(map[string]interface{})
+		if !isObject {
+			return fail(fmt.Sprintf("%s was already set to a value that is not an object", strings.Join(parts[:i+1], ".")))
+		}
+		m = nested
+	}
+	last := parts[len(parts)-1]
+	if _, exists := m[last]; exists {
+		return fail(fmt.Sprintf("%s was already set", key))
+	}
+	m[last] = value
+	return nil
 }
@@ -55,3 +55,65 @@ var disallowedVariant1 = variant{
 	input:  "(what) (if) (beep)",
 	output: map[string]interface{}{},
 }
+
+func TestTypedValues(t *testing.T) {
+	a := assert.New(t)
+
+	res, err := Parse(`(type post) (value.count 3) (value.ok true) (value.none null) (text "hello (there), \"you\"") (mentions [alice "bob c", 1.5 [false]])`)
+	a.NoError(err)
+	a.Equal(map[string]interface{}{
+		"type": "post",
+		"value": map[string]interface{}{
+			"count": 3.0,
+			"ok":    true,
+			"none":  nil,
+		},
+		"text":     `hello (there), "you"`,
+		"mentions": []interface{}{"alice", "bob c", 1.5, []interface{}{false}},
+	}, res)
+}
+
+func TestMergedNestedObjects(t *testing.T) {
+	a := assert.New(t)
+
+	res, err := Parse("(value.a x) (value.b y) (value.c.d z)")
+	a.NoError(err)
+	a.Equal(map[string]interface{}{
+		"value": map[string]interface{}{
+			"a": "x",
+			"b": "y",
+			"c": map[string]interface{}{"d": "z"},
+		},
+	}, res)
+}
+
+func TestJSONLiteral(t *testing.T) {
+	a := assert.New(t)
+
+	res, err := Parse(`{"type": "vote", "vote": {"link": "%abc", "value": 1, "expression": "Like"}}`)
+	a.NoError(err)
+	a.Equal(map[string]interface{}{
+		"type": "vote",
+		"vote": map[string]interface{}{"link": "%abc", "value": 1.0, "expression": "Like"},
+	}, res)
+}
+
+func TestErrors(t *testing.T) {
+	a := assert.New(t)
+
+	var cases = map[string]string{
+		"(type post) (text hi":       "column 13: ( is missing its closing )",
+		"(type post) text":           `column 13: expected ( to start a (key value) pair, found 't'`,
+		`(text "hello)`:              "column 7: string is missing its closing quote",
+		"(value.a x) (value.a.b y)":  "column 14: value.a was already set to a value that is not an object",
+		"(text hello (world))":       "column 13: unexpected ( in unquoted text; quote values containing it",
+		"(list [a b)":                "column 11: unexpected ) inside of [ ]",
+		`{"type": "post",}`:          "column 17: invalid character '}' looking for beginning of object key string",
+		`{"type": "post"} (text hi)`: "column 18: unexpected text after the json object",
+	}
+
+	for input, msg := range cases {
+		_, err := Parse(input)
+		a.EqualError(err, msg, input)
+	}
+}
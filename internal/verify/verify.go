@@ -0,0 +1,348 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+// Package verify checks the integrity of classic (ed25519 & sha256) SSB messages: their signatures, their keys and the
+// hash chain linking the messages of a feed.
+//
+// Signatures and hashes are computed over the message as serialized by V8's JSON.stringify(value, null, 2), which is
+// why messages are decoded into values that keep the order of their fields.
+package verify
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Field is a field of an Object
+type Field struct {
+	Key   string
+	Value interface{} // nil, bool, float64, string, []interface{} or *Object
+}
+
+// Object is a json object, which keeps its fields in the order they were decoded in
+type Object struct {
+	Fields []Field
+}
+
+// Get returns the value of the field called key
+func (o *Object) Get(key string) (interface{}, bool) {
+	for _, f := range o.Fields {
+		if f.Key == key {
+			return f.Value, true
+		}
+	}
+	return nil, false
+}
+
+// without returns a copy of o, minus the field called key
+func (o *Object) without(key string) *Object {
+	c := &Object{}
+	for _, f := range o.Fields {
+		if f.Key != key {
+			c.Fields = append(c.Fields, f)
+		}
+	}
+	return c
+}
+
+// Message is a message in the {key, value, timestamp} format returned by e.g. createHistoryStream with keys: true
+type Message struct {
+	Key   string
+	Value *Object
+	Raw   json.RawMessage
+
+	Author    string
+	Previous  string // empty for the first message of a feed
+	Sequence  int64
+	Signature string
+}
+
+// Decode decodes a message in the {key, value, timestamp} format
+func Decode(raw []byte) (Message, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	v, err := decodeValue(dec)
+	if err != nil {
+		return Message{}, fmt.Errorf("malformed message json (%w)", err)
+	}
+	wrapper, ok := v.(*Object)
+	if !ok {
+		return Message{}, errors.New("message was not a json object")
+	}
+	m := Message{Raw: raw}
+	m.Key, _ = getString(wrapper, "key")
+	value, _ := wrapper.Get("value")
+	if m.Value, ok = value.(*Object); !ok {
+		return Message{}, errors.New("message had no value object")
+	}
+	m.Author, _ = getString(m.Value, "author")
+	m.Previous, _ = getString(m.Value, "previous")
+	m.Signature, _ = getString(m.Value, "signature")
+	if seq, ok := m.Value.Get("sequence"); ok {
+		if f, isNumber := seq.(float64); isNumber {
+			m.Sequence = int64(f)
+		}
+	}
+	return m, nil
+}
+
+func getString(o *Object, key string) (string, bool) {
+	v, ok := o.Get(key)
+	if !ok {
+		return "", false
+	}
+	s, ok := v.(string)
+	return s, ok
+}
+
+func decodeValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		switch t {
+		case '{':
+			obj := &Object{}
+			for dec.More() {
+				keyTok, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				value, err := decodeValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				obj.Fields = append(obj.Fields, Field{Key: keyTok.(string), Value: value})
+			}
+			_, err = dec.Token() // }
+			return obj, err
+		case '[':
+			arr := []interface{}{}
+			for dec.More() {
+				value, err := decodeValue(dec)
+				if err != nil {
+					return nil, err
+				}
+				arr = append(arr, value)
+			}
+			_, err = dec.Token() // ]
+			return arr, err
+		}
+		return nil, fmt.Errorf("unexpected %v", t)
+	case json.Number:
+		return strconv.ParseFloat(t.String(), 64)
+	default:
+		// nil, bool or string
+		return t, nil
+	}
+}
+
+// Stringify serializes v like V8's JSON.stringify(v, null, 2)
+func Stringify(v interface{}) string {
+	var b strings.Builder
+	stringify(&b, v, "")
+	return b.String()
+}
+
+func stringify(w io.StringWriter, v interface{}, indent string) {
+	switch t := v.(type) {
+	case nil:
+		w.WriteString("null")
+	case bool:
+		w.WriteString(strconv.FormatBool(t))
+	case float64:
+		w.WriteString(formatNumber(t))
+	case string:
+		w.WriteString(quote(t))
+	case []interface{}:
+		if len(t) == 0 {
+			w.WriteString("[]")
+			return
+		}
+		w.WriteString("[\n")
+		for i, elem := range t {
+			w.WriteString(indent + "  ")
+			stringify(w, elem, indent+"  ")
+			if i < len(t)-1 {
+				w.WriteString(",")
+			}
+			w.WriteString("\n")
+		}
+		w.WriteString(indent + "]")
+	case *Object:
+		if len(t.Fields) == 0 {
+			w.WriteString("{}")
+			return
+		}
+		w.WriteString("{\n")
+		for i, f := range t.Fields {
+			w.WriteString(indent + "  " + quote(f.Key) + ": ")
+			stringify(w, f.Value, indent+"  ")
+			if i < len(t.Fields)-1 {
+				w.WriteString(",")
+			}
+			w.WriteString("\n")
+		}
+		w.WriteString(indent + "}")
+	}
+}
+
+// formatNumber formats f like javascript's Number.prototype.toString
+func formatNumber(f float64) string {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return "null"
+	}
+	if f == 0 {
+		return "0"
+	}
+	abs := math.Abs(f)
+	if abs >= 1e21 || abs < 1e-6 {
+		s := strconv.FormatFloat(f, 'e', -1, 64)
+		// go pads the exponent to two digits (1e-07), javascript doesn't (1e-7)
+		mantissa, exp := s[:strings.IndexByte(s, 'e')], s[strings.IndexByte(s, 'e')+1:]
+		sign := exp[0]
+		exp = strings.TrimLeft(exp[1:], "0")
+		return fmt.Sprintf("%se%c%s", mantissa, sign, exp)
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// quote quotes a string like JSON.stringify: only ", \ and control characters are escaped
+func quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(&b, `\u%04x`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// Hash computes the key of a message value. like ssb-keys, the serialized value is hashed as a "binary" (latin1)
+// string: only the low byte of each utf-16 code unit is kept
+func Hash(value *Object) string {
+	units := utf16.Encode([]rune(Stringify(value)))
+	b := make([]byte, len(units))
+	for i, u := range units {
+		b[i] = byte(u)
+	}
+	sum := sha256.Sum256(b)
+	return "%" + base64.StdEncoding.EncodeToString(sum[:]) + ".sha256"
+}
+
+// VerifySignature checks the signature of a message value against the public key of its author. the signature
+// covers the value without its signature field, serialized as utf-8
+func VerifySignature(value *Object) error {
+	author, _ := getString(value, "author")
+	pub, err := decodeSuffixed(strings.TrimPrefix(author, "@"), ".ed25519")
+	if err != nil || !strings.HasPrefix(author, "@") || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("author %q is not an ed25519 feed id", author)
+	}
+	signature, _ := getString(value, "signature")
+	sig, err := decodeSuffixed(signature, ".sig.ed25519")
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return fmt.Errorf("signature %q is not an ed25519 signature", signature)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(pub), []byte(Stringify(value.without("signature"))), sig) {
+		return errors.New("signature does not match the message")
+	}
+	return nil
+}
+
+func decodeSuffixed(s, suffix string) ([]byte, error) {
+	if !strings.HasSuffix(s, suffix) {
+		return nil, fmt.Errorf("missing %s suffix", suffix)
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSuffix(s, suffix))
+}
+
+// Divergence is the first problem found in a feed
+type Divergence struct {
+	Sequence int64 // the position in the feed where the problem was found
+	Reason   string
+}
+
+func (d Divergence) Error() string {
+	return fmt.Sprintf("message %d: %s", d.Sequence, d.Reason)
+}
+
+// Chain verifies the messages of a feed, one after the other
+type Chain struct {
+	Author string
+	prev   *Message
+}
+
+// Append verifies the next message of the feed, which must follow the previously appended message
+func (c *Chain) Append(m Message) error {
+	expectedSeq := int64(1)
+	if c.prev != nil {
+		expectedSeq = c.prev.Sequence + 1
+	}
+	diverge := func(format string, a ...interface{}) error {
+		return Divergence{Sequence: expectedSeq, Reason: fmt.Sprintf(format, a...)}
+	}
+
+	if m.Author != c.Author {
+		return diverge("author was %s, expected %s", m.Author, c.Author)
+	}
+	if m.Sequence != expectedSeq {
+		return diverge("sequence was %d; the sequence numbers of the feed are not contiguous", m.Sequence)
+	}
+	if c.prev == nil {
+		if previous, _ := m.Value.Get("previous"); previous != nil {
+			return diverge("the first message of a feed should have previous: null, was %v", previous)
+		}
+	} else if m.Previous != c.prev.Key {
+		return diverge("previous was %s, expected the key of message %d (%s)", m.Previous, c.prev.Sequence, c.prev.Key)
+	}
+	if err := VerifySignature(m.Value); err != nil {
+		return diverge("%s", err)
+	}
+	if hash := Hash(m.Value); m.Key != hash {
+		return diverge("key was %s, but the message hashes to %s", m.Key, hash)
+	}
+	c.prev = &m
+	return nil
+}
+
+// Verified returns the number of messages that were verified
+func (c *Chain) Verified() int64 {
+	if c.prev == nil {
+		return 0
+	}
+	return c.prev.Sequence
+}
@@ -0,0 +1,54 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package verify
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// two messages signed & hashed by node, with content exercising the finer points of JSON.stringify
+var feed = []string{
+	`{"key":"%sRwPzigjNWEIOMRL4kH0++sCwPMEJ+5Sj+qxM+Um794=.sha256","value":{"previous":null,"author":"@6kpsY+KcUgq+9VB7Ey7F+ZVHdq6+vnuSQh7qaRRG0iw=.ed25519","sequence":1,"timestamp":1618000000001.5,"hash":"sha256","content":{"type":"post","text":"héllo \"wörld\" ✓ 😀\n\ttab","n":1e-7,"big":1e+21,"list":[],"obj":{},"nested":[1,{"a":null,"b":true}]},"signature":"SfYhq/wUr75DyTzYaDp2l+c72acEozzfVF2+boLAjra5i0w1vZYdcZ8i6kTveBo/uEvitaiGu+FW2W+BXl0MBw==.sig.ed25519"},"timestamp":1}`,
+	`{"key":"%dMekQsVqGkQAyu+w0nnleYOW18XLTM/6bWXRNTa4gu4=.sha256","value":{"previous":"%sRwPzigjNWEIOMRL4kH0++sCwPMEJ+5Sj+qxM+Um794=.sha256","author":"@6kpsY+KcUgq+9VB7Ey7F+ZVHdq6+vnuSQh7qaRRG0iw=.ed25519","sequence":2,"timestamp":1618000000002.5,"hash":"sha256","content":{"type":"post","text":"héllo \"wörld\" ✓ 😀\n\ttab","n":1e-7,"big":1e+21,"list":[],"obj":{},"nested":[1,{"a":null,"b":true}]},"signature":"A2gM+qeTQGzP8iXYTUcJ/oMJHRm10gyHovaKJe66rPaLns7xx434L4l896MTEl5DjcuoUZ9AlQO/9LEkDfBuDQ==.sig.ed25519"},"timestamp":1}`,
+}
+
+func TestValidFeed(t *testing.T) {
+	a := assert.New(t)
+
+	chain := Chain{Author: "@6kpsY+KcUgq+9VB7Ey7F+ZVHdq6+vnuSQh7qaRRG0iw=.ed25519"}
+	for _, raw := range feed {
+		msg, err := Decode([]byte(raw))
+		a.NoError(err)
+		a.NoError(chain.Append(msg))
+	}
+	a.EqualValues(2, chain.Verified())
+}
+
+func TestDivergences(t *testing.T) {
+	a := assert.New(t)
+
+	var cases = map[string]struct {
+		index  int
+		edit   func(string) string
+		reason string
+	}{
+		"tampered content": {0, func(s string) string { return strings.Replace(s, "héllo", "hello", 1) }, "message 1: signature does not match the message"},
+		"reordered fields": {0, func(s string) string {
+			return strings.Replace(s, `"sequence":1,"timestamp":1618000000001.5`, `"timestamp":1618000000001.5,"sequence":1`, 1)
+		}, "message 1: signature does not match the message"},
+		"wrong key":       {0, func(s string) string { return strings.Replace(s, "%sRwP", "%xRwP", 1) }, "message 1: key was %xRwPzigjNWEIOMRL4kH0++sCwPMEJ+5Sj+qxM+Um794=.sha256, but the message hashes to %sRwPzigjNWEIOMRL4kH0++sCwPMEJ+5Sj+qxM+Um794=.sha256"},
+		"missing message": {1, func(s string) string { return s }, "message 1: sequence was 2; the sequence numbers of the feed are not contiguous"},
+	}
+
+	for name, c := range cases {
+		chain := Chain{Author: "@6kpsY+KcUgq+9VB7Ey7F+ZVHdq6+vnuSQh7qaRRG0iw=.ed25519"}
+		msg, err := Decode([]byte(c.edit(feed[c.index])))
+		a.NoError(err, name)
+		a.EqualError(chain.Append(msg), c.reason, name)
+	}
+}
@@ -0,0 +1,336 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.cryptoscope.co/muxrpc/v2"
+)
+
+// the kinds of muxrpc methods an sbot may implement, see sbotMethods
+const (
+	methodRequired = "required" // netsim can't test an implementation without it
+	methodExtra    = "extra"    // needed by some commands, which are skipped if it's missing
+	methodOptional = "optional" // makes netsim faster, but is never needed
+)
+
+// sbotMethods are the muxrpc methods netsim calls on the puppets' sbots, as listed in the README
+var sbotMethods = []struct {
+	name string
+	kind string
+}{
+	{"whoami", methodRequired},
+	{"publish", methodRequired},
+	{"createLogStream", methodRequired},
+	{"createHistoryStream", methodRequired},
+	{"conn.connect", methodRequired},
+	{"conn.disconnect", methodRequired},
+	{"friends.isFollowing", methodExtra},
+	{"friends.isBlocking", methodExtra},
+	{"getVectorClock", methodOptional},
+	{"db.getVectorClock", methodOptional},
+	{"ebt.clock", methodOptional},
+	{"replicate.upto", methodOptional},
+}
+
+// latestMethods are the methods which can be used to query latest sequences, see latestStrategies
+var latestMethods = latestStrategyNames()
+
+func latestStrategyNames() []string {
+	var names []string
+	for _, strategy := range latestStrategies {
+		names = append(names, strategy.name)
+	}
+	return append(names, logStreamStrategy.name)
+}
+
+// commandMethods lists the methods each command calls on the sbot of the puppet named by its first argument. a
+// command can be executed as long as the sbot implements at least one method of each of the command's groups
+var commandMethods = map[string][][]string{
+	"log":            {{"createLogStream"}},
+	"has":            {latestMethods},
+	"waituntil":      {{"createHistoryStream"}},
+	"hasmsg":         {{"createHistoryStream"}},
+	"verifyfeed":     {{"createHistoryStream"}},
+	"post":           {{"publish"}},
+	"publish":        {{"publish"}},
+	"follow":         {{"publish"}},
+	"unfollow":       {{"publish"}},
+	"block":          {{"publish"}},
+	"unblock":        {{"publish"}},
+	"isfollowing":    {{"friends.isFollowing"}},
+	"isnotfollowing": {{"friends.isFollowing"}},
+	"isblocked":      {{"friends.isBlocking"}},
+	"isnotblocked":   {{"friends.isBlocking"}},
+	"connect":        {{"conn.connect"}},
+	"disconnect":     {{"conn.disconnect"}},
+}
+
+func methodKind(name string) string {
+	for _, m := range sbotMethods {
+		if m.name == name {
+			return m.kind
+		}
+	}
+	return methodOptional
+}
+
+// queryManifest returns the methods listed by the manifest of p's sbot, by their dotted names
+func queryManifest(p *Puppet) (map[string]bool, error) {
+	var manifest map[string]interface{}
+	var empty interface{}
+	err := asyncRequest(p, muxrpc.Method{"manifest"}, &empty, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	methods := make(map[string]bool)
+	flattenManifest(manifest, "", methods)
+	return methods, nil
+}
+
+// flattenManifest adds the methods of a manifest, where plugins nest their methods as {"conn": {"connect": "async"}}
+func flattenManifest(manifest map[string]interface{}, prefix string, methods map[string]bool) {
+	for name, v := range manifest {
+		switch v := v.(type) {
+		case string:
+			methods[prefix+name] = true
+		case map[string]interface{}:
+			flattenManifest(v, prefix+name+".", methods)
+		}
+	}
+}
+
+// supportedMethods returns the methods implemented by p's sbot, queried once per run of the puppet. nil means that
+// the sbot didn't answer with a manifest, and that its methods are unknown
+func supportedMethods(p *Puppet) map[string]bool {
+	if methods, queried := p.rpc.manifest(); queried {
+		return methods
+	}
+	methods, err := queryManifest(p)
+	if err != nil {
+		p.notes.add(fmt.Sprintf("%s: could not query the manifest of its sbot (%s); not checking for missing methods", p.name, err))
+		methods = nil
+	}
+	p.rpc.setManifest(methods)
+	return methods
+}
+
+// missingMethods checks that the sbot of the puppet which instr is executed against implements the methods instr
+// needs. if it doesn't, a description of what's missing is returned, along with whether any of it is required
+func (s Simulator) missingMethods(instr Instruction) (string, bool) {
+	groups, ok := commandMethods[instr.command]
+	if !ok || len(instr.args) == 0 {
+		return "", false
+	}
+	s.mu.Lock()
+	p, exists := s.puppetMap[instr.args[0]]
+	s.mu.Unlock()
+	// puppets which aren't running are reported by the command itself
+	if !exists || !p.isExecuting() {
+		return "", false
+	}
+	methods := supportedMethods(p)
+	if methods == nil {
+		return "", false
+	}
+	for _, group := range groups {
+		if implementsAny(methods, group) {
+			continue
+		}
+		required := false
+		for _, name := range group {
+			required = required || methodKind(name) == methodRequired
+		}
+		missing := group[0]
+		if len(group) > 1 {
+			missing = fmt.Sprintf("any of %s", strings.Join(group, ", "))
+		}
+		return fmt.Sprintf("%s's sbot (%s) doesn't implement %s, which %s needs; see `netsim doctor %s`",
+			p.name, p.implementation, missing, instr.command, p.implementation), required
+	}
+	return "", false
+}
+
+func implementsAny(methods map[string]bool, group []string) bool {
+	for _, name := range group {
+		if methods[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// commandsUsing returns the commands which call method, sorted
+func commandsUsing(method string) []string {
+	var commands []string
+	for command, groups := range commandMethods {
+		for _, group := range groups {
+			if implementsAny(map[string]bool{method: true}, group) {
+				commands = append(commands, command)
+				break
+			}
+		}
+	}
+	sort.Strings(commands)
+	return commands
+}
+
+// doctorText is published by `netsim doctor`, and read back to check the round trip
+const doctorText = "netsim doctor"
+
+// Doctor checks how well the implementation in the sbot folder supports netsim: it starts a throwaway puppet with the
+// implementation's sim-shim.sh, checks which of the muxrpc methods used by netsim its manifest lists, and exercises
+// the methods with a publish & read round trip. the results are printed as a table, and the number of problems which
+// would keep the implementation from being tested is returned
+func Doctor(args Args, sbot string) int {
+	// stdout is reserved for the results, the simulator's own logging goes to stderr
+	defaultReporter = newTAPReporter(os.Stderr)
+	tmp, err := os.MkdirTemp("", "netsim-doctor-")
+	if err != nil {
+		bail(err.Error())
+	}
+	defer os.RemoveAll(tmp)
+	args.Outdir = preparePuppetDir(tmp)
+	s := makeSimulator(args, []string{sbot})
+	defer s.cancelExecution()
+
+	var implementation string
+	for name := range s.implementations {
+		implementation = name
+	}
+	p := &Puppet{
+		name:           "doctor",
+		caps:           s.caps,
+		hops:           s.hops,
+		port:           s.acquirePort(),
+		implementation: implementation,
+		directory:      filepath.Join(s.puppetDir, fmt.Sprintf("%s-doctor", implementation)),
+		rpc:            &rpcConn{},
+		resources:      &resourceMonitor{},
+		notes:          &puppetNotes{},
+	}
+	logfile := filepath.Join(s.puppetDir, "doctor.txt")
+	if err := p.start(s, implementation); err != nil {
+		fmt.Printf("could not start %s (%s)\n", implementation, err)
+		printLogTail(logfile)
+		return 1
+	}
+	defer func() {
+		p.stop(Instruction{})
+		for _, note := range p.notes.drain() {
+			taplog(note)
+		}
+	}()
+
+	// wait for the sbot to start answering
+	var feedID string
+	for retries := 0; retries < 15; retries++ {
+		time.Sleep(time.Second)
+		if feedID, err = DoWhoami(p); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		fmt.Printf("%s did not answer whoami (%s)\n", implementation, err)
+		printLogTail(logfile)
+		return 1
+	}
+	p.feedID = feedID
+
+	problems := 0
+	methods := supportedMethods(p)
+	fmtString := "%-22s %-10s %-10s %s\n"
+	fmt.Printf("Methods of %s, as listed by its manifest\n", implementation)
+	fmt.Printf(fmtString, "Method", "Kind", "Listed", "Used by")
+	for _, m := range sbotMethods {
+		listed := "?"
+		if methods != nil {
+			listed = "yes"
+			if !methods[m.name] {
+				listed = "MISSING"
+				if m.kind == methodRequired {
+					problems++
+				}
+			}
+		}
+		usedBy := strings.Join(commandsUsing(m.name), ", ")
+		if m.kind == methodOptional {
+			usedBy = "faster latest sequences (has, converged, stop)"
+		}
+		fmt.Printf(fmtString, m.name, m.kind, listed, usedBy)
+	}
+	if methods == nil {
+		fmt.Println("(the sbot didn't answer the manifest call; only the round trips below were checked)")
+	}
+
+	fmt.Printf("\nRound trips\n")
+	fmtString = "%-22s %-6s %s\n"
+	check := func(name string, err error, detail string) bool {
+		if err != nil {
+			problems++
+			fmt.Printf(fmtString, name, "FAIL", err)
+			return false
+		}
+		fmt.Printf(fmtString, name, "ok", detail)
+		return true
+	}
+	check("whoami", nil, feedID)
+	if !check("publish", DoPublish(p, map[string]interface{}{"type": "post", "text": doctorText}), "published a post") {
+		fmt.Println("(nothing was published, so reading it back was not checked)")
+		return problems
+	}
+
+	messages, err := readHistory(p, feedID, 1, 1)
+	if err == nil && len(messages) == 0 {
+		err = errors.New("the published post was not returned")
+	}
+	if err == nil {
+		err = checkDoctorPost(messages[0])
+	}
+	check("createHistoryStream", err, "read the post back")
+
+	latest, err := scanLogStream(p, feedID)
+	if l, has := getLatestByFeedID(latest, feedID); err == nil && (!has || l.Sequence != 1) {
+		err = fmt.Errorf("expected the feed at sequence 1, found %v", latest)
+	}
+	check("createLogStream", err, "found the post")
+
+	l, has, err := queryFeedLatest(p, feedID)
+	if err == nil && (!has || l.Sequence != 1) {
+		err = fmt.Errorf("expected the feed at sequence 1, was %d", l.Sequence)
+	}
+	strategy := "?"
+	if st := p.rpc.latestStrategy(); st != nil {
+		strategy = st.name
+	}
+	check("latest sequences", err, fmt.Sprintf("queried with %s", strategy))
+	return problems
+}
+
+// checkDoctorPost checks that a message read back by Doctor is the post it published
+func checkDoctorPost(raw []byte) error {
+	var msg map[string]interface{}
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		return fmt.Errorf("malformed message (%w)", err)
+	}
+	if text, _ := lookupField(msg, "value.content.text"); text != doctorText {
+		return fmt.Errorf("expected the post to have text %q, was %v", doctorText, text)
+	}
+	return nil
+}
+
+func printLogTail(logfile string) {
+	if tail, err := tailFile(logfile, junitLogTail); err == nil && tail != "" {
+		fmt.Printf("--- last lines of %s ---\n%s\n", logfile, tail)
+	}
+}
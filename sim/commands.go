@@ -16,8 +16,6 @@ import (
 
 	"go.cryptoscope.co/muxrpc/v2"
 	refs "go.mindeco.de/ssb-refs"
-
-	"github.com/ssb-ngi-pointer/netsim/client"
 )
 
 type Whoami struct {
@@ -31,7 +29,7 @@ type Latest struct {
 }
 
 func asyncRequest(p *Puppet, method muxrpc.Method, payload, response interface{}) error {
-	c, err := client.NewTCP(p.port, p.caps, fmt.Sprintf("%s/secret", p.directory))
+	c, err := p.rpc.endpoint(p)
 	if err != nil {
 		return err
 	}
@@ -43,108 +41,52 @@ func asyncRequest(p *Puppet, method muxrpc.Method, payload, response interface{}
 	}
 	err = c.Async(ctx, response, muxEncodingType, method, payload)
 	if err != nil {
+		// if the session died underneath us, make sure the next request dials a new one
+		p.rpc.invalidate()
 		return err
 	}
-
-	c.Terminate()
 	return nil
 }
 
-func sourceRequest(p *Puppet, method muxrpc.Method, opts interface{}) (muxrpc.Endpoint, *muxrpc.ByteSource, error) {
-	c, err := client.NewTCP(p.port, p.caps, fmt.Sprintf("%s/secret", p.directory))
+// sourceRequest opens a source stream on the puppet's shared muxrpc session. the stream lives until ctx is canceled;
+// callers should cancel ctx once they are done reading, as the session itself stays open
+func sourceRequest(ctx context.Context, p *Puppet, method muxrpc.Method, opts interface{}) (*muxrpc.ByteSource, error) {
+	c, err := p.rpc.endpoint(p)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	ctx := context.TODO()
 	src, err := c.Source(ctx, muxrpc.TypeJSON, method, opts)
-	return c, src, err
+	if err != nil {
+		p.rpc.invalidate()
+		return nil, err
+	}
+	return src, nil
 }
 
 func DoConnect(src, dst *Puppet) error {
-	dstMultiAddr := multiserverAddr(dst)
+	// src reaches dst through the relay link dedicated to the pair, so that the netsim can shape the traffic
+	port, err := dst.relay.portFor(src)
+	if err != nil {
+		return err
+	}
+	dstMultiAddr := multiserverAddr(dst, port)
 
 	var response interface{}
 	return asyncRequest(src, muxrpc.Method{"conn", "connect"}, dstMultiAddr, &response)
 }
 
 func DoDisconnect(src, dst *Puppet) error {
-	dstMultiAddr := multiserverAddr(dst)
+	port, ok := dst.relay.existingPort(src)
+	if !ok {
+		return fmt.Errorf("%s was never connected to %s", src.name, dst.name)
+	}
+	dstMultiAddr := multiserverAddr(dst, port)
 
 	var response interface{}
 	return asyncRequest(src, muxrpc.Method{"conn", "disconnect"}, dstMultiAddr, &response)
 }
 
-func queryLatest(p *Puppet) ([]Latest, error) {
-	// this is currently way less efficient than using `replicate.upto`. replicate.upto however doesn't work in a ssb-db2
-	// context, and nobody seems to want to patch that into ssb-db2 as a compat muxrpc so here we go
-	type logStreamResponse struct {
-		Value struct {
-			Author    string
-			Sequence  int `json:"sequence"`
-			Timestamp int `json:"timestamp"`
-		} `json:"value"`
-	}
-
-	type sourceOptions struct {
-		Reverse bool `json:"reverse"`
-		Keys    bool `json:"keys"`
-	}
-
-	// explicitly set the Keys property to make the go & js stacks return the data in the same format
-	opts := sourceOptions{Reverse: true, Keys: true}
-	c, src, err := sourceRequest(p, muxrpc.Method{"createLogStream"}, opts)
-	if err != nil {
-		return []Latest{}, err
-	}
-	defer c.Terminate()
-
-	ctx := context.TODO()
-	// count all log stream responses in a map of pubkey->counter
-	counters := make(map[string]int)
-	parseLogStream := func(rd io.Reader) error {
-		// read all the json-encoded data as bytes
-		b, err := io.ReadAll(rd)
-		if err != nil {
-			return err
-		}
-
-		// TODO (2021-09-17): is there some way we can terminate the loop calling parseLogStream? since we're streaming
-		// records in reverse, it is likely that we will encounter all the latest sequences that a particular puppet has in
-		// their database way earlier than when all messages are exhausted. terminating earlier would mean less time spent
-		// in this routine for very large (100k+) databases, since json.Unmarshal is so time-consuming
-
-		// decode the response bits we care about
-		var resp logStreamResponse
-		err = json.Unmarshal(b, &resp)
-		if err != nil {
-			return err
-		}
-
-		// only update the map if the encountered sequence number is larger than what we already have stored
-		_, exist := counters[resp.Value.Author]
-		if !exist {
-			counters[resp.Value.Author] = 0
-		}
-		counters[resp.Value.Author] += 1
-		return nil
-	}
-
-	for src.Next(ctx) {
-		err = src.Reader(parseLogStream)
-		if err != nil {
-			return []Latest{}, err
-		}
-	}
-
-	var latest []Latest
-	for author, seqno := range counters {
-		latest = append(latest, Latest{ID: author, Sequence: seqno, TS: 0})
-	}
-
-	return latest, nil
-}
-
 func extractSeqno(dst *Puppet, seqno string) (int, string, error) {
 	var assertedSeqno int
 	var assumption string
@@ -164,11 +106,10 @@ func extractSeqno(dst *Puppet, seqno string) (int, string, error) {
 
 // really bad Rammstein pun, sorry (absolutely not sorry)
 func DoHast(src, dst *Puppet, seqno string) (string, error) {
-	srcLatestSeqs, err := queryLatest(src)
+	dstViaSrc, has, err := queryFeedLatest(src, dst.feedID)
 	if err != nil {
 		return "", err
 	}
-	dstViaSrc, has := getLatestByFeedID(srcLatestSeqs, dst.feedID)
 
 	// what if the dst puppet doesn't even know about it
 	if !has {
@@ -225,16 +166,15 @@ func DoCreateHistoryStream(p *Puppet, who string, n int, live bool) (string, err
 		Live:  live,
 		Limit: 1,
 	}
-	c, src, err := sourceRequest(p, muxrpc.Method{"createHistoryStream"}, opts)
+	ctx := context.TODO() // TODO get simulation context
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	src, err := sourceRequest(ctx, p, muxrpc.Method{"createHistoryStream"}, opts)
 	if err != nil {
 		return "", err
 	}
-	defer c.Terminate()
 
 	var response []string
-	ctx := context.TODO() // TODO get simulation context
-	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
-	defer cancel()
 	if !src.Next(ctx) {
 		if err := src.Err(); err != nil {
 			return "", fmt.Errorf("createHistStream failed: %w", err)
@@ -269,14 +209,14 @@ func DoLog(p *Puppet, n int) (string, error) {
 
 	// only get the last n logs
 	opts := sourceOptions{Limit: n, Reverse: true, Keys: true}
-	c, src, err := sourceRequest(p, muxrpc.Method{"createLogStream"}, opts)
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	src, err := sourceRequest(ctx, p, muxrpc.Method{"createLogStream"}, opts)
 	if err != nil {
 		return "", err
 	}
-	defer c.Terminate()
 
 	var response []string
-	ctx := context.TODO()
 
 	for src.Next(ctx) {
 		err = src.Reader(prettyPrintSourceJSON(&response))
@@ -328,6 +268,22 @@ func DoFollow(srcPuppet, dstPuppet *Puppet, isFollow bool) error {
 	return err
 }
 
+func DoBlock(srcPuppet, dstPuppet *Puppet, isBlock bool) error {
+	feedRef, err := refs.ParseFeedRef(dstPuppet.feedID)
+	if err != nil {
+		return err
+	}
+
+	// a block is a contact message with `blocking: true`, which also ends any follow of the blocked feed
+	blockContent := refs.NewContactFollow(feedRef)
+	blockContent.Following = false
+	blockContent.Blocking = isBlock
+
+	var response string
+	err = asyncRequest(srcPuppet, muxrpc.Method{"publish"}, blockContent, &response)
+	return err
+}
+
 func DoPost(p *Puppet) error {
 	post := refs.NewPost("bep")
 
@@ -341,6 +297,15 @@ func DoPublish(p *Puppet, post map[string]interface{}) error {
 }
 
 func queryIsFollowing(srcPuppet, dstPuppet *Puppet) (bool, error) {
+	return queryRelation(srcPuppet, dstPuppet, muxrpc.Method{"friends", "isFollowing"})
+}
+
+func queryIsBlocking(srcPuppet, dstPuppet *Puppet) (bool, error) {
+	return queryRelation(srcPuppet, dstPuppet, muxrpc.Method{"friends", "isBlocking"})
+}
+
+// queryRelation asks srcPuppet's sbot about its relation to dstPuppet, using one of the friends.is* calls
+func queryRelation(srcPuppet, dstPuppet *Puppet, method muxrpc.Method) (bool, error) {
 	srcRef, err := refs.ParseFeedRef(srcPuppet.feedID)
 	if err != nil {
 		return false, err
@@ -356,11 +321,15 @@ func queryIsFollowing(srcPuppet, dstPuppet *Puppet) (bool, error) {
 	}{Source: &srcRef, Dest: &dstRef}
 
 	var response interface{}
-	err = asyncRequest(srcPuppet, muxrpc.Method{"friends", "isFollowing"}, arg, &response)
+	err = asyncRequest(srcPuppet, method, arg, &response)
 	if err != nil {
 		return false, err
 	}
-	return response.(bool), nil
+	relation, ok := response.(bool)
+	if !ok {
+		return false, fmt.Errorf("%s returned %v, expected a boolean", strings.Join(method, "."), response)
+	}
+	return relation, nil
 }
 
 func DoIsFollowing(srcPuppet, dstPuppet *Puppet) error {
@@ -387,3 +356,28 @@ func DoIsNotFollowing(srcPuppet, dstPuppet *Puppet) error {
 	}
 	return nil
 }
+
+func DoIsBlocking(srcPuppet, dstPuppet *Puppet) error {
+	isBlocking, err := queryIsBlocking(srcPuppet, dstPuppet)
+	if err != nil {
+		return err
+	}
+	if !isBlocking {
+		m := fmt.Sprintf("%s did not block %s", srcPuppet.feedID, dstPuppet.feedID)
+		return TestError{err: errors.New("isblocking returned false"), message: m}
+	}
+	return nil
+}
+
+func DoIsNotBlocking(srcPuppet, dstPuppet *Puppet) error {
+	isBlocking, err := queryIsBlocking(srcPuppet, dstPuppet)
+	if err != nil {
+		return err
+	}
+	if isBlocking {
+		srcID, dstID := srcPuppet.feedID, dstPuppet.feedID
+		m := fmt.Sprintf("%s should not block %s\nactual: %s is blocking %s", srcID, dstID, srcID, dstID)
+		return TestError{err: errors.New("isblocking returned true"), message: m}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ssb-ngi-pointer/netsim/client"
+)
+
+// rpcConn is a puppet's long-lived muxrpc session. it is opened lazily by the first request after `start`, shared by
+// all subsequent commands, transparently redialed if the session dies, and closed on `stop`
+type rpcConn struct {
+	mu     sync.Mutex
+	conn   *client.Conn
+	target *rpcTarget // where the puppet's running sbot listens; nil while it isn't running, so nothing is dialed
+
+	handshakes    int           // number of secret handshakes performed against the puppet
+	handshakeTime time.Duration // total time spent performing those handshakes
+
+	latest *latestStrategy // how the puppet's latest sequences are queried; probed once per run of the puppet
+
+	methods         map[string]bool // the methods listed by the sbot's manifest; nil if they're unknown
+	manifestQueried bool
+}
+
+// rpcTarget is the address and credentials a puppet's sbot was started with. it's copied when the sbot is started, so
+// that the session can be redialed without reading the puppet, which the instructions may be changing meanwhile
+type rpcTarget struct {
+	port int
+	caps string
+	dir  string
+}
+
+// open lets the session be dialed, at the port p's sbot has just been started on
+func (c *rpcConn) open(p *Puppet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.target = &rpcTarget{port: p.port, caps: p.caps, dir: p.directory}
+}
+
+// running reports whether the puppet's sbot has been started, and not stopped since
+func (c *rpcConn) running() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.target != nil
+}
+
+// endpoint returns the current muxrpc session of p, dialing a new one if there is none or the previous one died
+func (c *rpcConn) endpoint(p *Puppet) (*client.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.target == nil {
+		return nil, fmt.Errorf("%s is not running", p.name)
+	}
+	if c.conn != nil && c.conn.Alive() {
+		return c.conn, nil
+	}
+	if c.conn != nil && c.conn.Err() != nil {
+		p.notes.add(fmt.Sprintf("%s: muxrpc session was lost (%s); reconnecting", p.name, c.conn.Err()))
+	}
+	conn, err := client.Dial(c.target.port, c.target.caps, fmt.Sprintf("%s/secret", c.target.dir))
+	if err != nil {
+		c.conn = nil
+		return nil, err
+	}
+	c.handshakes += 1
+	c.handshakeTime += conn.Handshake
+	c.conn = conn
+	return conn, nil
+}
+
+// invalidate drops the current session if it has died, so that the next request dials a fresh one
+func (c *rpcConn) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil && !c.conn.Alive() {
+		c.conn = nil
+	}
+}
+
+// latestStrategy returns the strategy settled on for querying latest sequences, or nil if the puppet hasn't been
+// probed yet
+func (c *rpcConn) latestStrategy() *latestStrategy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.latest
+}
+
+func (c *rpcConn) setLatestStrategy(p *Puppet, strategy *latestStrategy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// a probe that was still underway when the puppet was stopped doesn't hold for its next run
+	if c.target == nil {
+		return
+	}
+	if c.latest == nil {
+		p.notes.add(fmt.Sprintf("%s: querying latest sequences with %s", p.name, strategy.name))
+	}
+	c.latest = strategy
+}
+
+// manifest returns the methods listed by the sbot's manifest, and whether the manifest has been queried yet
+func (c *rpcConn) manifest() (map[string]bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.methods, c.manifestQueried
+}
+
+func (c *rpcConn) setManifest(methods map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.methods, c.manifestQueried = methods, true
+}
+
+// close tears down the current session, if any, and keeps it from being redialed until the puppet is started again.
+// the puppet may be started with another implementation next, so the latest sequence strategy and the manifest are
+// queried anew
+func (c *rpcConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.target = nil
+	c.latest = nil
+	c.methods, c.manifestQueried = nil, false
+	if c.conn == nil {
+		return
+	}
+	c.conn.Terminate()
+	c.conn = nil
+}
@@ -0,0 +1,31 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionOfStoppedPuppet(t *testing.T) {
+	a := assert.New(t)
+
+	p := &Puppet{name: "alice", port: 18888, directory: t.TempDir(), rpc: &rpcConn{}, notes: &puppetNotes{}}
+	a.False(p.rpc.running())
+	_, err := p.rpc.endpoint(p)
+	a.EqualError(err, "alice is not running")
+
+	p.rpc.open(p)
+	a.True(p.rpc.running())
+	// once stopped, the session mustn't be redialed, e.g. by the sampler
+	p.rpc.close()
+	a.False(p.rpc.running())
+	_, err = p.rpc.endpoint(p)
+	a.EqualError(err, "alice is not running")
+	p.rpc.setLatestStrategy(p, &logStreamStrategy)
+	a.Nil(p.rpc.latestStrategy())
+	a.Empty(p.notes.drain())
+}
@@ -0,0 +1,222 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// convergence is what a set of puppets know about the feeds they have in common
+type convergence struct {
+	puppets []*Puppet
+	latest  []map[string]int    // per puppet: feed id => latest sequence
+	keys    []map[string]string // per puppet: feed id => key of the latest message; only queried with +keys
+	labels  map[string]string   // feed id => name of the puppet owning the feed, for display
+}
+
+// DoConverged checks that the puppets agree on every feed that at least two of them hold: they must all be at the same
+// latest sequence and, if withKeys is set, have the same message at that sequence. feeds that only one of the puppets
+// holds are ignored, as they may be out of the hops of the others
+func DoConverged(puppets []*Puppet, labels map[string]string, withKeys bool) (string, error) {
+	c := convergence{puppets: puppets, labels: labels, latest: make([]map[string]int, len(puppets))}
+	g := new(errgroup.Group)
+	for i := range puppets {
+		i := i
+		g.Go(func() error {
+			latest, err := queryLatest(puppets[i])
+			if err != nil {
+				return fmt.Errorf("%s could not list its feeds (%w)", puppets[i].name, err)
+			}
+			c.latest[i] = make(map[string]int)
+			for _, l := range latest {
+				c.latest[i][l.ID] = l.Sequence
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return "", err
+	}
+
+	shared := c.sharedFeeds()
+	var behind []string
+	for _, feed := range shared {
+		if c.max(feed) != c.min(feed) {
+			behind = append(behind, feed)
+		}
+	}
+
+	var forked []string
+	if withKeys {
+		if err := c.queryKeys(shared); err != nil {
+			return "", err
+		}
+		for _, feed := range shared {
+			if c.max(feed) == c.min(feed) && !c.sameKeys(feed) {
+				forked = append(forked, feed)
+			}
+		}
+	}
+
+	names := make([]string, len(puppets))
+	for i, p := range puppets {
+		names[i] = p.name
+	}
+	if len(behind) == 0 && len(forked) == 0 {
+		agreement := "latest sequences"
+		if withKeys {
+			agreement = "latest sequences & messages"
+		}
+		return fmt.Sprintf("%s agree on the %s of %d shared feeds", strings.Join(names, ", "), agreement, len(shared)), nil
+	}
+
+	var b strings.Builder
+	if len(behind) > 0 {
+		fmt.Fprintf(&b, "%d of %d shared feeds differ (sequences; -n is how far a puppet is behind, - means it doesn't hold the feed)\n", len(behind), len(shared))
+		b.WriteString(c.matrix(behind))
+	}
+	for _, feed := range forked {
+		fmt.Fprintf(&b, "the puppets hold different messages at %s@%d:\n", c.label(feed), c.max(feed))
+		for i, p := range puppets {
+			if key, ok := c.keys[i][feed]; ok {
+				fmt.Fprintf(&b, "  %-12s %s\n", p.name, key)
+			}
+		}
+	}
+	return "", TestError{err: errors.New("puppets have not converged"), message: strings.TrimRight(b.String(), "\n")}
+}
+
+// sharedFeeds returns the feeds held by at least two of the puppets, sorted by label
+func (c convergence) sharedFeeds() []string {
+	holders := make(map[string]int)
+	for _, latest := range c.latest {
+		for feed := range latest {
+			holders[feed]++
+		}
+	}
+	var shared []string
+	for feed, count := range holders {
+		if count >= 2 {
+			shared = append(shared, feed)
+		}
+	}
+	sort.Slice(shared, func(i, j int) bool {
+		return c.label(shared[i]) < c.label(shared[j])
+	})
+	return shared
+}
+
+func (c convergence) max(feed string) int {
+	max := -1
+	for _, latest := range c.latest {
+		if seq, ok := latest[feed]; ok && seq > max {
+			max = seq
+		}
+	}
+	return max
+}
+
+func (c convergence) min(feed string) int {
+	min := -1
+	for _, latest := range c.latest {
+		if seq, ok := latest[feed]; ok && (min == -1 || seq < min) {
+			min = seq
+		}
+	}
+	return min
+}
+
+// queryKeys fetches the key of the latest message of each shared feed, from each puppet holding it
+func (c *convergence) queryKeys(shared []string) error {
+	c.keys = make([]map[string]string, len(c.puppets))
+	g := new(errgroup.Group)
+	for i := range c.puppets {
+		i := i
+		c.keys[i] = make(map[string]string)
+		g.Go(func() error {
+			for _, feed := range shared {
+				seq, ok := c.latest[i][feed]
+				if !ok {
+					continue
+				}
+				messages, err := readHistory(c.puppets[i], feed, seq, 1)
+				if err != nil {
+					return fmt.Errorf("%s could not read %s@%d (%w)", c.puppets[i].name, c.label(feed), seq, err)
+				}
+				if len(messages) == 0 {
+					continue
+				}
+				var msg struct {
+					Key string `json:"key"`
+				}
+				if err := json.Unmarshal(messages[0], &msg); err != nil {
+					return fmt.Errorf("%s returned a malformed message for %s@%d (%w)", c.puppets[i].name, c.label(feed), seq, err)
+				}
+				c.keys[i][feed] = msg.Key
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+func (c convergence) sameKeys(feed string) bool {
+	var first string
+	for _, keys := range c.keys {
+		key, ok := keys[feed]
+		if !ok {
+			continue
+		}
+		if first == "" {
+			first = key
+		} else if key != first {
+			return false
+		}
+	}
+	return true
+}
+
+// matrix formats the latest sequences of feeds, with a row per feed and a column per puppet
+func (c convergence) matrix(feeds []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-14s", "feed")
+	for _, p := range c.puppets {
+		fmt.Fprintf(&b, " %12s", p.name)
+	}
+	b.WriteString("\n")
+	for _, feed := range feeds {
+		max := c.max(feed)
+		fmt.Fprintf(&b, "%-14s", c.label(feed))
+		for i := range c.puppets {
+			cell := "-"
+			if seq, ok := c.latest[i][feed]; ok {
+				cell = fmt.Sprintf("%d", seq)
+				if seq < max {
+					cell = fmt.Sprintf("%d (-%d)", seq, max-seq)
+				}
+			}
+			fmt.Fprintf(&b, " %12s", cell)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// label returns the name of the puppet owning feed, or an abbreviated feed id for feeds not owned by any puppet
+func (c convergence) label(feed string) string {
+	if name, ok := c.labels[feed]; ok {
+		return name
+	}
+	if len(feed) > 12 {
+		return feed[:12] + "…"
+	}
+	return feed
+}
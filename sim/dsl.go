@@ -13,16 +13,15 @@ import (
 	"log"
 	"net"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/ssb-ngi-pointer/netsim/internal/parser"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -36,11 +35,16 @@ type Args struct {
 	Outdir      string // directory where puppet logs & files will be dumped
 	BasePort    int    // starting port used for instantiating the ports used by puppets
 	Verbose     bool   // produce more output when running (echoes puppet output in realtime, in addition to TAP assertions)
-}
-
-type Process struct {
-	cmd     *exec.Cmd
-	logfile *os.File
+	Report      string // optional: path of the machine-readable json report written at the end of the run
+	Version     string // the version of netsim, included in the report
+	Format      string // output format of the results: tap (default) or junit
+	// optional: how often to sample the progress & resource usage of running puppets; 0 disables sampling
+	SampleInterval time.Duration
+	Samples        string // path of the samples file; csv, unless it's named .ndjson or .jsonl
+	// optional: derive the identities of puppets that don't load one from the fixtures from this seed
+	IdentitySeed string
+	SnapshotDir  string // directory where the snapshots of `snapshot` are kept; ./snapshots if empty
+	FromSnapshot string // optional: label of the snapshot to restore before running the test
 }
 
 // TODO: convert all uses of testError to fmt.Errorf(msg + %w)
@@ -70,21 +74,35 @@ type Simulator struct {
 	implementations map[string]string
 	puppetDir       string
 	caps            string // secret handshake capability key; also termed `shscap` (and sometimes appkey?) in ssb-go
-	portCounter     int
+	portCounter     *int
 	instr           Instruction
 	instructions    []Instruction
 	basePort        int
 	hops            int
 	verbose         bool
 	fixtures        string
+	identitySeed    string // the default seed of puppet identities, see seededKeyPair; empty if sbots create their own
+	snapshotDir     string
 	timers          map[string]*Timer
+	network         *network // relays and simulated network conditions between puppets
+	report          *Report
+	reportPath      string
+	sampler         *sampler // nil unless --sample-interval was passed
+	interactive     bool     // set by netsim repl, where aborting an instruction doesn't end the simulation
+	// guards the maps & counters above, which are shared by every copy of the simulator. copies are made when
+	// executing the instructions of a `parallel` block concurrently
+	mu *sync.Mutex
 
 	rootCtx         context.Context
 	cancelExecution context.CancelFunc
 }
 
+// errCanceled is returned when the simulation was interrupted while executing an instruction
+var errCanceled = errors.New("execution was canceled")
+
 func bail(msg string) {
-	fmt.Printf("Bail out! %s\n", msg)
+	defaultReporter.Bail(msg)
+	defaultReporter.Finish()
 	os.Exit(1)
 }
 
@@ -145,74 +163,107 @@ func makeSimulator(args Args, sbots []string) Simulator {
 		hops:            args.Hops,
 		verbose:         args.Verbose,
 		fixtures:        args.FixturesDir,
+		identitySeed:    args.IdentitySeed,
+		snapshotDir:     snapshotDirPath(args.SnapshotDir),
+		network:         newNetwork(),
+		report:          newReport(args, langMap),
+		reportPath:      args.Report,
+		portCounter:     new(int),
+		mu:              new(sync.Mutex),
 	}
 
 	sim.rootCtx, sim.cancelExecution = context.WithCancel(context.Background())
 	return sim
 }
 
-func (s Simulator) getSecretDir(id string) string {
+func (s Simulator) getSecretDir(id string) (string, error) {
 	info, has := s.fixturesIds[id]
 	if !has {
-		s.Abort(fmt.Errorf("cannot find id %s when getting secret dir", id))
-		return ""
+		return "", fmt.Errorf("cannot find id %s when getting secret dir", id)
 	}
-	return info.Folder
+	return info.Folder, nil
 }
 
-func (s Simulator) getInstructionArg(n int) string {
-	var arg string
-	var err error
+func (s Simulator) getInstructionArg(n int) (string, error) {
 	switch n {
 	case 1:
-		arg, err = s.instr.first()
+		return s.instr.first()
 	case 2:
-		arg, err = s.instr.second()
-	default:
-		s.Abort(fmt.Errorf("getInstructionArg(): no such arg %d", n))
+		return s.instr.second()
+	case 3:
+		return s.instr.third()
 	}
-	if err != nil {
-		s.Abort(err)
-	}
-	return arg
+	return "", fmt.Errorf("getInstructionArg(): no such arg %d", n)
 }
 
-func (s Simulator) getFixturesLatestSeqno(id string) int {
+func (s Simulator) getFixturesLatestSeqno(id string) (int, error) {
 	info, has := s.fixturesIds[id]
 	if !has {
-		s.Abort(fmt.Errorf("cannot find id %s when getting latest seqno", id))
-		return -1
+		return -1, fmt.Errorf("cannot find id %s when getting latest seqno", id)
 	}
-	return info.Latest
+	return info.Latest, nil
 }
 
-func (s Simulator) getSrcPuppet() *Puppet {
+func (s Simulator) getSrcPuppet() (*Puppet, error) {
 	return s.getPuppet(s.instr.getSrc())
 }
 
-func (s Simulator) getDstPuppet() *Puppet {
-	return s.getPuppet(s.instr.getDst())
+// getSrcDstPuppets returns the puppets named by the first two arguments of the instruction
+func (s Simulator) getSrcDstPuppets() (*Puppet, *Puppet, error) {
+	src, err := s.getPuppet(s.instr.getSrc())
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := s.getPuppet(s.instr.getDst())
+	return src, dst, err
 }
 
 func (s *Simulator) ParseTest(lines []string) {
-	s.instructions = make([]Instruction, 0, len(lines))
-	if s.verbose {
-		fmt.Println("## Start test file")
-	}
+	statements := make([]statement, 0, len(lines))
 	for i, line := range lines {
-		if strings.TrimSpace(line) == "" {
-			s.Abort(fmt.Errorf("line %d was empty; empty lines are not allowed", i+1))
+		statements = append(statements, statement{text: line, line: i + 1})
+	}
+	s.parseStatements("", statements, nil)
+}
+
+// parseStatements expands the variables, loops & macros of the test, and turns the resulting statements into
+// instructions. the instructions are numbered sequentially, and remember the file & line they were written on.
+// testfile is the file passed to netsim, which lines were read from; roles binds the implementation roles it uses
+func (s *Simulator) parseStatements(testfile string, lines []statement, roles map[string]string) {
+	for _, line := range lines {
+		if strings.TrimSpace(line.text) == "" {
+			s.Abort(fmt.Errorf("%s was empty; empty lines are not allowed", line.pos()))
 			return
 		}
-		instr := parseTestLine(line, i+1)
-		if s.verbose {
+	}
+	expanded, err := expandTest(lines, roles)
+	if err != nil {
+		s.Abort(err)
+		return
+	}
+	s.instructions = makeInstructions(testfile, expanded)
+	if s.verbose {
+		taplog("Start test file")
+		for _, instr := range s.instructions {
 			instr.Print()
 		}
-		s.instructions = append(s.instructions, instr)
+		taplog("End test file")
 	}
-	if s.verbose {
-		fmt.Println("## End test file")
+	s.report.track(s.instructions)
+}
+
+// makeInstructions numbers the expanded statements of testfile, and turns them into instructions
+func makeInstructions(testfile string, expanded []statement) []Instruction {
+	instructions := make([]Instruction, 0, len(expanded))
+	for i, stmt := range expanded {
+		instr := parseTestLine(stmt.text, i+1)
+		instr.source = stmt
+		if stmt.file != testfile || stmt.line != instr.id {
+			instr.origin = stmt.pos()
+		}
+		instructions = append(instructions, instr)
 	}
+	return instructions
 }
 
 func (s Simulator) evaluateRun(err error) {
@@ -225,6 +276,9 @@ func (s Simulator) evaluateRun(err error) {
 
 func (s *Simulator) updateCurrentInstruction(instr Instruction) {
 	s.instr = instr
+	if s.sampler != nil {
+		s.sampler.setInstruction(instr)
+	}
 }
 
 func listenOnPort(port int) func() error {
@@ -241,13 +295,15 @@ func listenOnPort(port int) func() error {
 	}
 }
 
-func (s *Simulator) acquirePort() int {
+func (s Simulator) acquirePort() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	maxAttempts := 100
-	startPort := s.basePort + s.portCounter
+	startPort := s.basePort + *s.portCounter
 
 	for i := 0; i < maxAttempts; i = i + 2 {
-		port := s.basePort + s.portCounter
-		s.portCounter += 2
+		port := s.basePort + *s.portCounter
+		*s.portCounter += 2
 		// try to acquire two sequential ports: one for muxrpc communication, the other for sbot's websockets support.
 		// websockets is currently not used by the netsim, but the port needs to be specified for the sbots process
 		g := new(errgroup.Group)
@@ -267,6 +323,7 @@ func (s *Simulator) acquirePort() int {
 type Sleeper struct {
 	elapsed time.Time
 	sim     Simulator
+	forked  bool // sleepers of parallel branches leave the accounting of puppet sleep durations to their parent
 }
 
 type Timer struct {
@@ -279,6 +336,15 @@ type Timer struct {
 func (s *Sleeper) sleep(d time.Duration) {
 	s.elapsed = s.elapsed.Add(d)
 	time.Sleep(d)
+	if s.forked {
+		return
+	}
+	s.recordSleep(d)
+}
+
+func (s *Sleeper) recordSleep(d time.Duration) {
+	s.sim.mu.Lock()
+	defer s.sim.mu.Unlock()
 	// iterate through puppets & record sleep duration for those currently running at time of sleep
 	for _, puppet := range s.sim.puppetMap {
 		if puppet.isExecuting() {
@@ -287,6 +353,29 @@ func (s *Sleeper) sleep(d time.Duration) {
 	}
 }
 
+// fork creates a sleeper for a branch of a parallel block
+func (s *Sleeper) fork() *Sleeper {
+	return &Sleeper{sim: s.sim, forked: true}
+}
+
+// join accounts for the time slept by the branches of a parallel block. since the branches slept concurrently, we
+// approximate the time the whole simulation was idle with the shortest time slept by any of them
+func (s *Sleeper) join(branches []*Sleeper) {
+	var zero time.Time
+	idle := time.Duration(-1)
+	for _, branch := range branches {
+		slept := branch.elapsed.Sub(zero)
+		if idle < 0 || slept < idle {
+			idle = slept
+		}
+	}
+	if idle <= 0 {
+		return
+	}
+	s.elapsed = s.elapsed.Add(idle)
+	s.recordSleep(idle)
+}
+
 func (s Simulator) isCanceled() bool {
 	select {
 	case <-s.rootCtx.Done():
@@ -299,372 +388,959 @@ func (s Simulator) isCanceled() bool {
 }
 
 func (s Simulator) execute() {
-	sleeper := Sleeper{sim: s}
+	sleeper := &Sleeper{sim: s}
 	start := time.Now()
-	for _, instr := range s.instructions {
+	if !s.executeAll(sleeper) {
+		return
+	}
+	defaultReporter.Plan(len(s.instructions))
+
+	elapsed := time.Since(start)
+	var t time.Time
+	t = t.Add(elapsed)
+	cpuTime := t.Sub(sleeper.elapsed)
+
+	for _, note := range s.drainNotes() {
+		taplog(note)
+	}
+	taplog("End of simulation")
+	taplog(fmt.Sprintf("Total time: %s", elapsed.String()))
+	taplog(fmt.Sprintf("Active time: %s", cpuTime.String()))
+	taplog(fmt.Sprintf("Puppet count: %d", len(s.puppetMap)))
+}
+
+// executeAll executes the instructions in order, returning false if the execution was canceled or aborted
+func (s Simulator) executeAll(sleeper *Sleeper) bool {
+	for i := 0; i < len(s.instructions); i++ {
 		// check if we have received any cancellations before continuing on to process test commands
 		if s.isCanceled() {
-			return
+			return false
 		}
 
+		instr := s.instructions[i]
 		s.updateCurrentInstruction(instr)
-		switch instr.command {
-		case "#", "comment":
-			instr.TestSuccess()
-		case "enter":
-			name := s.getInstructionArg(1)
-			p := Puppet{
-				name: name,
-				caps: s.caps,
-				hops: s.hops,
-			}
-			s.puppetMap[name] = &p
-			instr.TestSuccess()
-		case "load":
-			if s.fixtures == "" {
-				s.Abort(errors.New("no fixtures provided with --fixtures, yet tried to load feed from log.offset"))
-				continue
-			}
-			name := s.getInstructionArg(1)
-			id := s.getInstructionArg(2)
+		var err error
+		if instr.command == "parallel" {
+			// run the whole block, and continue after its closing `end`
+			i, err = s.executeParallel(i, sleeper)
+		} else {
+			err = s.timedStep(instr, sleeper)
+		}
 
-			p := s.getPuppet(name)
-			p.secretDir = s.getSecretDir(id)
-			p.seqno = s.getFixturesLatestSeqno(id)
-			p.feedID = id
-			instr.TestSuccess()
-		case "skipoffset":
-			name := s.getInstructionArg(1)
-			p := s.getPuppet(name)
-			p.omitOffset = true
-			instr.TestSuccess()
-		case "alloffsets":
-			name := s.getInstructionArg(1)
-			p := s.getPuppet(name)
-			p.allOffsets = true
-			instr.TestSuccess()
-		case "hops":
-			name := s.getInstructionArg(1)
-			arg := s.getInstructionArg(2)
-			hops, err := strconv.Atoi(arg)
-			if err != nil {
-				s.Abort(err)
-				continue
-			}
-			p := s.getPuppet(name)
-			p.hops = hops
-			instr.TestSuccess()
-		case "caps":
-			name := s.getInstructionArg(1)
-			caps := s.getInstructionArg(2)
-			// perform validation on caps
-			_, err := base64.StdEncoding.DecodeString(caps)
-			if err != nil {
-				s.Abort(err)
-				continue
-			}
-			p := s.getPuppet(name)
-			p.caps = caps
-			instr.TestSuccess()
-		case "reset":
-			name := s.getInstructionArg(1)
-			langImpl := s.getInstructionArg(2)
-			if _, ok := s.implementations[langImpl]; !ok {
-				err := errors.New(fmt.Sprintf("no such language implementation passed to simulator on startup (%s)", langImpl))
-				s.Abort(err)
-				return
-			}
-			p := s.getPuppet(name)
-			// puppet directory was empty => it was never started
-			if p.directory == "" {
-				instr.TestSuccess()
-				taplog(fmt.Sprintf("there was no execution folder to reset for %s", p.name))
-				continue
-			}
-			subfolder := fmt.Sprintf("%s-%s", langImpl, name)
-			fullpath := filepath.Join(s.puppetDir, subfolder)
+		if errors.Is(err, errCanceled) {
+			return false
+		}
+		var abort abortError
+		if errors.As(err, &abort) {
+			// the branch's recorded output has already been replayed, report the abort directly
+			abort.instr.output = nil
+			s.updateCurrentInstruction(abort.instr)
+			err = abort.err
+		}
+		if err != nil {
+			s.Abort(err)
+			return false
+		}
+	}
+	return true
+}
 
-			absdir, err := filepath.Abs(fullpath)
-			if err != nil {
-				s.Abort(fmt.Errorf("%s errored during reset (%w)", p.name, err))
-				return
-			}
-			// remove the created puppet dir, thus resetting its starting state
-			err = os.RemoveAll(absdir)
-			if err != nil {
-				s.Abort(fmt.Errorf("%s errored during reset (%w)", p.name, err))
-				return
-			}
+// step executes a single instruction, reporting its outcome. a returned error means the simulation has to be aborted
+func (s Simulator) step(instr Instruction, sleeper *Sleeper) error {
+	if crashed := s.crashedPuppet(instr); crashed != nil {
+		instr.TestFailure(fmt.Errorf("%s's sbot is not running, it exited unexpectedly (%s); see %s.txt", crashed.name, crashed.process.exitState(), crashed.name))
+		return nil
+	}
+	if missing, required := s.missingMethods(instr); missing != "" {
+		if required {
+			instr.TestFailure(errors.New(missing))
+		} else {
+			instr.TestSkip(missing)
+		}
+		return nil
+	}
+	switch instr.command {
+	case "#", "comment":
+		instr.TestSuccess()
+	case "enter":
+		name, err := s.getInstructionArg(1)
+		if err != nil {
+			return err
+		}
+		s.enterPuppet(name)
+		instr.TestSuccess()
+	case "load":
+		if s.fixtures == "" {
+			return errors.New("no fixtures provided with --fixtures, yet tried to load feed from log.offset")
+		}
+		name, err := s.getInstructionArg(1)
+		if err != nil {
+			return err
+		}
+		id, err := s.getInstructionArg(2)
+		if err != nil {
+			return err
+		}
+
+		p, err := s.getPuppet(name)
+		if err != nil {
+			return err
+		}
+		if p.secretDir, err = s.getSecretDir(id); err != nil {
+			return err
+		}
+		if p.seqno, err = s.getFixturesLatestSeqno(id); err != nil {
+			return err
+		}
+		p.feedID = id
+		instr.TestSuccess()
+	case "identity":
+		name, err := s.getInstructionArg(1)
+		if err != nil {
+			return err
+		}
+		seed, err := s.getInstructionArg(2)
+		if err != nil {
+			return err
+		}
+		p, err := s.getPuppet(name)
+		if err != nil {
+			return err
+		}
+		if p.secretDir != "" {
+			return fmt.Errorf("%s already loaded its identity from the fixtures", name)
+		}
+		if p.isExecuting() {
+			return fmt.Errorf("%s is running; stop it before changing its identity", name)
+		}
+		// the log in the puppet's directory belongs to the identity it was started with
+		if _, err := os.Stat(p.directory); p.directory != "" && err == nil {
+			return fmt.Errorf("%s already has a directory with the log of its previous identity; reset it before giving it a new one", name)
+		}
+		p.identitySeed = seed
+		instr.TestSuccess()
+	case "snapshot":
+		label, err := s.getInstructionArg(1)
+		if err != nil {
+			return err
+		}
+		if err := s.snapshot(instr, label, sleeper); err != nil {
+			return fmt.Errorf("could not take snapshot (%w)", err)
+		}
+		instr.TestSuccess()
+	case "restore":
+		label, err := s.getInstructionArg(1)
+		if err != nil {
+			return err
+		}
+		if err := s.restore(instr, label, sleeper); err != nil {
+			return fmt.Errorf("could not restore snapshot (%w)", err)
+		}
+		instr.TestSuccess()
+	case "skipoffset":
+		name, err := s.getInstructionArg(1)
+		if err != nil {
+			return err
+		}
+		p, err := s.getPuppet(name)
+		if err != nil {
+			return err
+		}
+		p.omitOffset = true
+		instr.TestSuccess()
+	case "alloffsets":
+		name, err := s.getInstructionArg(1)
+		if err != nil {
+			return err
+		}
+		p, err := s.getPuppet(name)
+		if err != nil {
+			return err
+		}
+		p.allOffsets = true
+		instr.TestSuccess()
+	case "hops":
+		name, err := s.getInstructionArg(1)
+		if err != nil {
+			return err
+		}
+		arg, err := s.getInstructionArg(2)
+		if err != nil {
+			return err
+		}
+		hops, err := strconv.Atoi(arg)
+		if err != nil {
+			return err
+		}
+		p, err := s.getPuppet(name)
+		if err != nil {
+			return err
+		}
+		p.hops = hops
+		instr.TestSuccess()
+	case "caps":
+		name, err := s.getInstructionArg(1)
+		if err != nil {
+			return err
+		}
+		caps, err := s.getInstructionArg(2)
+		if err != nil {
+			return err
+		}
+		// perform validation on caps
+		_, err = base64.StdEncoding.DecodeString(caps)
+		if err != nil {
+			return err
+		}
+		p, err := s.getPuppet(name)
+		if err != nil {
+			return err
+		}
+		p.caps = caps
+		instr.TestSuccess()
+	case "reset":
+		name, err := s.getInstructionArg(1)
+		if err != nil {
+			return err
+		}
+		langImpl, err := s.getInstructionArg(2)
+		if err != nil {
+			return err
+		}
+		if _, ok := s.implementations[langImpl]; !ok {
+			err := errors.New(fmt.Sprintf("no such language implementation passed to simulator on startup (%s)", langImpl))
+			return err
+		}
+		p, err := s.getPuppet(name)
+		if err != nil {
+			return err
+		}
+		// puppet directory was empty => it was never started
+		if p.directory == "" {
 			instr.TestSuccess()
-			taplog(fmt.Sprintf("removed %s", subfolder))
-		case "start":
-			name := s.getInstructionArg(1)
-			langImpl := s.getInstructionArg(2)
-			if _, ok := s.implementations[langImpl]; !ok {
-				err := errors.New(fmt.Sprintf("no such language implementation passed to simulator on startup (%s)", langImpl))
-				s.Abort(err)
-				return
-			}
-			p := s.getPuppet(name)
-			subfolder := fmt.Sprintf("%s-%s", langImpl, name)
-			fullpath := filepath.Join(s.puppetDir, subfolder)
-			p.port = s.acquirePort()
-			p.directory = fullpath
-
-			err := p.start(s, langImpl)
-			p.lastStart = time.Now()
-			if err != nil {
-				instr.TestFailure(err)
-				continue
+			instr.taplog(fmt.Sprintf("there was no execution folder to reset for %s", p.name))
+			return nil
+		}
+		subfolder := fmt.Sprintf("%s-%s", langImpl, name)
+		fullpath := filepath.Join(s.puppetDir, subfolder)
+
+		absdir, err := filepath.Abs(fullpath)
+		if err != nil {
+			return fmt.Errorf("%s errored during reset (%w)", p.name, err)
+		}
+		// remove the created puppet dir, thus resetting its starting state
+		err = os.RemoveAll(absdir)
+		if err != nil {
+			return fmt.Errorf("%s errored during reset (%w)", p.name, err)
+		}
+		instr.TestSuccess()
+		instr.taplog(fmt.Sprintf("removed %s", subfolder))
+	case "start":
+		name, err := s.getInstructionArg(1)
+		if err != nil {
+			return err
+		}
+		langImpl, err := s.getInstructionArg(2)
+		if err != nil {
+			return err
+		}
+		if _, ok := s.implementations[langImpl]; !ok {
+			err := errors.New(fmt.Sprintf("no such language implementation passed to simulator on startup (%s)", langImpl))
+			return err
+		}
+		p, err := s.getPuppet(name)
+		if err != nil {
+			return err
+		}
+		err = s.launchPuppet(instr, p, langImpl, sleeper)
+		var failure launchFailure
+		if errors.As(err, &failure) {
+			instr.TestFailure(failure.err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		instr.TestSuccess()
+		feedStr := "feeds"
+		if p.totalFeeds == 1 {
+			feedStr = "feed"
+		}
+		instr.taplog(fmt.Sprintf("%s (%d messages, %d %s) has id %s ", name, p.totalMessages, p.totalFeeds, feedStr, p.feedID))
+		instr.taplog(fmt.Sprintf("logging to %s.txt", name))
+	case "stop":
+		name, err := s.getInstructionArg(1)
+		if err != nil {
+			return err
+		}
+		p, err := s.getPuppet(name)
+		if err != nil {
+			return err
+		}
+		err = p.stop(instr)
+		if err != nil {
+			return err
+		}
+		p.stopTimer()
+		instr.TestSuccess()
+		instr.taplog(fmt.Sprintf("%s has been stopped", name))
+	case "log":
+		srcPuppet, err := s.getSrcPuppet()
+		if err != nil {
+			return err
+		}
+		arg, err := s.getInstructionArg(2)
+		if err != nil {
+			return err
+		}
+		amount, err := strconv.Atoi(arg)
+		if err != nil {
+			return err
+		}
+		msg, err := DoLog(srcPuppet, amount)
+		s.evaluateRun(err)
+		instr.taplog(msg)
+	case "timerstart":
+		label, err := s.getInstructionArg(1)
+		if err != nil {
+			return err
+		}
+		var timer *Timer
+		s.mu.Lock()
+		if t, ok := s.timers[label]; ok {
+			t.start, t.running = time.Now(), true
+			timer = t
+		} else { // first time we're creating this timer
+			timer = &Timer{order: len(s.timers), start: time.Now(), running: true}
+		}
+		s.timers[label] = timer
+		s.mu.Unlock()
+		instr.taplog(fmt.Sprintf("timer %s started", label))
+		instr.TestSuccess()
+	case "timerstop":
+		label, err := s.getInstructionArg(1)
+		if err != nil {
+			return err
+		}
+		// the timer may be started or stopped by a sibling branch of a parallel block, so it's only touched under the lock
+		s.mu.Lock()
+		timer, ok := s.timers[label]
+		running := ok && timer.running
+		var elapsed time.Duration
+		if running {
+			timer.elapsed += time.Since(timer.start)
+			timer.running = false
+			elapsed = timer.elapsed
+		}
+		s.mu.Unlock()
+
+		if !ok {
+			instr.TestFailure(fmt.Errorf("timer %s did not exist", label))
+			return nil
+		}
+		if !running {
+			instr.TestFailure(fmt.Errorf("timer %s existed, but was not currently started", label))
+			return nil
+		}
+		instr.TestSuccess()
+		instr.taplog(fmt.Sprintf("timer %s stopped, current time: %s", label, elapsed.Truncate(time.Millisecond)))
+	case "wait":
+		arg, err := s.getInstructionArg(1)
+		if err != nil {
+			return err
+		}
+		ms, err := time.ParseDuration(fmt.Sprintf("%sms", arg))
+		if err != nil {
+			instr.TestFailure(err)
+			return nil
+		}
+		sleeper.sleep(ms)
+		instr.TestSuccess()
+	case "waituntil":
+		line, err := s.getInstructionArg(2)
+		if err != nil {
+			return err
+		}
+		arg := strings.Split(line, "@")
+		if len(arg) < 2 {
+			return fmt.Errorf("waituntil statement was missing @<seqno> (%s)", line)
+		}
+		dst, seq := arg[0], arg[1]
+		srcPuppet, err := s.getSrcPuppet()
+		if err != nil {
+			return err
+		}
+		dstPuppet, err := s.getPuppet(dst)
+		if err != nil {
+			return err
+		}
+		MAX_RETRIES := 10
+		var message string
+		// kludge: we've been having rare issues of go-muxrpc failing on the waituntil command.  this kludge simply
+		// retries any failures, as the call is generally likely to succeed. typically, we only saw a failure once in a
+		// ~416 line netsim test.
+		for retries := 0; retries < MAX_RETRIES; retries++ {
+			message, err = DoWaitUntil(srcPuppet, dstPuppet, seq)
+			if err == nil {
+				break
+			} else {
+				if s.isCanceled() {
+					return errCanceled
+				}
+				instr.retried()
+				instr.taplog(fmt.Sprintf("waituntil had an error on attempt %d/%d (%s) ", retries, MAX_RETRIES, err))
+				sleeper.sleep(1 * time.Second)
 			}
-			// give the sbot process some time to start
-			sleeper.sleep(2 * time.Second)
-
-			// a retry loop that tries to ping puppet's sbot, exits when ok or max retries reached
-			const MAX_RETRIES = 15
-			var feedID string
-			for retries := 0; retries < MAX_RETRIES; retries++ {
-				feedID, err = DoWhoami(p)
-				if err == nil {
-					break
-				} else {
-					if s.isCanceled() {
-						return
-					}
-					taplog(fmt.Sprintf("waiting for %s sbot to start; retry %d/%d", p.name, retries, MAX_RETRIES))
-					if s.verbose {
-						taplog(fmt.Sprintf("%s", err))
-					}
-					sleeper.sleep(5 * time.Second)
+		}
+		s.evaluateRun(err)
+		if err == nil {
+			// the message we get back is of the type "interpreting <name>@latest as <name>@<seqno>"
+			instr.taplog(message)
+		}
+	case "unfollow":
+		fallthrough
+	case "follow":
+		srcPuppet, dstPuppet, err := s.getSrcDstPuppets()
+		if err != nil {
+			return err
+		}
+		// TODO: check id and err if id not set
+		err = DoFollow(srcPuppet, dstPuppet, instr.command == "follow")
+		s.evaluateRun(err)
+		srcPuppet.bumpSeqno()
+	case "isfollowing":
+		srcPuppet, dstPuppet, err := s.getSrcDstPuppets()
+		if err != nil {
+			return err
+		}
+		err = DoIsFollowing(srcPuppet, dstPuppet)
+		s.evaluateRun(err)
+	case "isnotfollowing":
+		srcPuppet, dstPuppet, err := s.getSrcDstPuppets()
+		if err != nil {
+			return err
+		}
+		err = DoIsNotFollowing(srcPuppet, dstPuppet)
+		s.evaluateRun(err)
+	case "unblock":
+		fallthrough
+	case "block":
+		srcPuppet, dstPuppet, err := s.getSrcDstPuppets()
+		if err != nil {
+			return err
+		}
+		err = DoBlock(srcPuppet, dstPuppet, instr.command == "block")
+		s.evaluateRun(err)
+		srcPuppet.bumpSeqno()
+	case "isblocked":
+		srcPuppet, dstPuppet, err := s.getSrcDstPuppets()
+		if err != nil {
+			return err
+		}
+		err = DoIsBlocking(srcPuppet, dstPuppet)
+		s.evaluateRun(err)
+	case "isnotblocked":
+		srcPuppet, dstPuppet, err := s.getSrcDstPuppets()
+		if err != nil {
+			return err
+		}
+		err = DoIsNotBlocking(srcPuppet, dstPuppet)
+		s.evaluateRun(err)
+	case "post":
+		srcPuppet, err := s.getSrcPuppet()
+		if err != nil {
+			return err
+		}
+		err = DoPost(srcPuppet)
+		s.evaluateRun(err)
+		srcPuppet.bumpSeqno()
+	case "publish":
+		obj, err := parseMessage(instr, 2)
+		if err != nil {
+			return err
+		}
+		srcPuppet, err := s.getSrcPuppet()
+		if err != nil {
+			return err
+		}
+		err = DoPublish(srcPuppet, obj)
+		s.evaluateRun(err)
+		srcPuppet.bumpSeqno()
+	case "disconnect":
+		srcPuppet, dstPuppet, err := s.getSrcDstPuppets()
+		if err != nil {
+			return err
+		}
+		err = DoDisconnect(srcPuppet, dstPuppet)
+		s.evaluateRun(err)
+	case "connect":
+		srcPuppet, dstPuppet, err := s.getSrcDstPuppets()
+		if err != nil {
+			return err
+		}
+		err = DoConnect(srcPuppet, dstPuppet)
+		// TODO: re-evaluate need of sleeping after connection
+		// current need: make sure no puppet tries to hit the remote sbot too quickly (saw some error with like EOF
+		// something something)
+		sleeper.sleep(500 * time.Millisecond)
+		s.evaluateRun(err)
+	case "latency":
+		srcPuppet, dstPuppet, err := s.getSrcDstPuppets()
+		if err != nil {
+			return err
+		}
+		arg, err := s.getInstructionArg(3)
+		if err != nil {
+			return err
+		}
+		latency, err := parseLatency(arg)
+		if err != nil {
+			return err
+		}
+		s.network.setLatency(srcPuppet.name, dstPuppet.name, latency)
+		instr.TestSuccess()
+		instr.taplog(fmt.Sprintf("%s <-> %s: delaying traffic by %s in each direction", srcPuppet.name, dstPuppet.name, latency))
+	case "droprate":
+		srcPuppet, dstPuppet, err := s.getSrcDstPuppets()
+		if err != nil {
+			return err
+		}
+		arg, err := s.getInstructionArg(3)
+		if err != nil {
+			return err
+		}
+		rate, err := parseDroprate(arg)
+		if err != nil {
+			return err
+		}
+		s.network.setDroprate(srcPuppet.name, dstPuppet.name, rate)
+		instr.TestSuccess()
+		instr.taplog(fmt.Sprintf("%s <-> %s: losing %.2f%% of traffic", srcPuppet.name, dstPuppet.name, rate*100))
+	case "bandwidth":
+		srcPuppet, err := s.getSrcPuppet()
+		if err != nil {
+			return err
+		}
+		arg, err := s.getInstructionArg(2)
+		if err != nil {
+			return err
+		}
+		bitrate, err := parseBandwidth(arg)
+		if err != nil {
+			return err
+		}
+		s.network.setBandwidth(srcPuppet.name, bitrate)
+		instr.TestSuccess()
+		if bitrate == 0 {
+			instr.taplog(fmt.Sprintf("%s: removed bandwidth cap", srcPuppet.name))
+		} else {
+			instr.taplog(fmt.Sprintf("%s: capped bandwidth at %s (%d bits/s) up & down", srcPuppet.name, arg, bitrate))
+		}
+	case "partition":
+		groups, err := parsePartitionGroups(instr.line)
+		if err != nil {
+			return err
+		}
+		for _, group := range groups {
+			for _, name := range group {
+				if _, err := s.getPuppet(name); err != nil {
+					return err
 				}
 			}
+		}
+		s.network.partition(groups)
+		instr.TestSuccess()
+	case "heal":
+		s.network.heal()
+		instr.TestSuccess()
+		instr.taplog("removed all network partitions")
+	case "has":
+		line, err := s.getInstructionArg(2)
+		if err != nil {
+			return err
+		}
+		arg := strings.Split(line, "@")
+		if len(arg) < 2 {
+			return fmt.Errorf("has statement was missing @<seqno> (%s)", line)
+		}
+		dst, seq := arg[0], arg[1]
+		srcPuppet, err := s.getSrcPuppet()
+		if err != nil {
+			return err
+		}
+		dstPuppet, err := s.getPuppet(dst)
+		if err != nil {
+			return err
+		}
+		message, err := DoHast(srcPuppet, dstPuppet, seq)
+		s.evaluateRun(err)
+		if err == nil {
+			// the message we get back is of the type "interpreting <name>@latest as <name>@<seqno>"
+			instr.taplog(message)
+		}
+	case "hasmsg":
+		line, err := s.getInstructionArg(2)
+		if err != nil {
+			return err
+		}
+		arg := strings.Split(line, "@")
+		if len(arg) < 2 {
+			return fmt.Errorf("hasmsg statement was missing @<seqno> (%s)", line)
+		}
+		fields, err := parseMessage(instr, 3)
+		if err != nil {
+			return err
+		}
+		dst, seq := arg[0], arg[1]
+		srcPuppet, err := s.getSrcPuppet()
+		if err != nil {
+			return err
+		}
+		dstPuppet, err := s.getPuppet(dst)
+		if err != nil {
+			return err
+		}
+		message, err := DoHasMessage(srcPuppet, dstPuppet, seq, fields)
+		s.evaluateRun(err)
+		if err == nil {
+			instr.taplog(message)
+		}
+	case "verifyfeed":
+		srcPuppet, dstPuppet, err := s.getSrcDstPuppets()
+		if err != nil {
+			return err
+		}
+		message, err := DoVerifyFeed(srcPuppet, dstPuppet)
+		s.evaluateRun(err)
+		if err == nil {
+			instr.taplog(message)
+		}
+	case "converged":
+		withKeys := len(instr.args) > 0 && instr.args[0] == "+keys"
+		names := instr.args
+		if withKeys {
+			names = names[1:]
+		}
+		puppets, err := s.convergedPuppets(names)
+		if err != nil {
+			return err
+		}
+		if len(puppets) < 2 {
+			return fmt.Errorf("converged needs at least two running puppets to compare, got %d", len(puppets))
+		}
+		labels := make(map[string]string)
+		s.mu.Lock()
+		for name, p := range s.puppetMap {
+			labels[p.feedID] = name
+		}
+		s.mu.Unlock()
+		message, err := DoConverged(puppets, labels, withKeys)
+		s.evaluateRun(err)
+		if err == nil {
+			instr.taplog(message)
+		}
+	case "parallel":
+		return errors.New("parallel blocks can't be nested")
+	case "end":
+		return errors.New("end without a matching parallel")
+	default:
+		// unknown command, abort test run
+		return errors.New("Unknown simulator command")
+	}
+	return nil
+}
 
-			// if we still have an error after going through the retries, it's time to abort
-			// cause somethin' aint workin
-			if err != nil {
-				s.Abort(fmt.Errorf("%s errored during start (%w)", p.name, err))
-				return
-			}
+// enterPuppet declares the puppet name, with the default settings of the simulation
+func (s Simulator) enterPuppet(name string) *Puppet {
+	p := &Puppet{
+		name:         name,
+		caps:         s.caps,
+		hops:         s.hops,
+		identitySeed: s.identitySeed,
+		rpc:          &rpcConn{},
+		resources:    &resourceMonitor{},
+		notes:        &puppetNotes{},
+	}
+	p.relay = s.network.relayFor(p)
+	s.mu.Lock()
+	s.puppetMap[name] = p
+	s.mu.Unlock()
+	return p
+}
 
-			// if running with fixtures: validate feedID matches feedID defined by `load <p.name> <id>`
-			if p.usesFixtures() {
-				if p.feedID != feedID {
-					s.Abort(fmt.Errorf("%s feed id was expected as %s, was %s", p.name, p.feedID, feedID))
-					return
-				}
-			} else {
-				p.feedID = feedID
-			}
+// launchFailure is a failure to launch a puppet which fails the instruction, rather than aborting the simulation
+type launchFailure struct {
+	err error
+}
 
-			err = p.countMessages()
-			if err != nil {
-				instr.TestFailure(err)
-				continue
-			}
-			instr.TestSuccess()
-			feedStr := "feeds"
-			if p.totalFeeds == 1 {
-				feedStr = "feed"
-			}
-			taplog(fmt.Sprintf("%s (%d messages, %d %s) has id %s ", name, p.totalMessages, p.totalFeeds, feedStr, p.feedID))
-			taplog(fmt.Sprintf("logging to %s.txt", name))
-		case "stop":
-			name := s.getInstructionArg(1)
-			p := s.getPuppet(name)
-			err := p.stop()
-			if err != nil {
-				s.Abort(err)
-			}
-			p.stopTimer()
-			instr.TestSuccess()
-			taplog(fmt.Sprintf("%s has been stopped", name))
-		case "log":
-			srcPuppet := s.getSrcPuppet()
-			arg := s.getInstructionArg(2)
-			amount, err := strconv.Atoi(arg)
-			if err != nil {
-				log.Fatalln(err)
-			}
-			msg, err := DoLog(srcPuppet, amount)
-			s.evaluateRun(err)
-			taplog(msg)
-		case "timerstart":
-			label := s.getInstructionArg(1)
-			var timer *Timer
-			if t, ok := s.timers[label]; ok {
-				t.start, t.running = time.Now(), true
-				timer = t
-			} else { // first time we're creating this timer
-				timer = &Timer{order: len(s.timers), start: time.Now(), running: true}
-			}
-			s.timers[label] = timer
-			taplog(fmt.Sprintf("timer %s started", label))
-			instr.TestSuccess()
-		case "timerstop":
-			label := s.getInstructionArg(1)
-			timer, ok := s.timers[label]
+func (f launchFailure) Error() string {
+	return f.err.Error()
+}
 
-			if !ok {
-				instr.TestFailure(fmt.Errorf("timer %s did not exist", label))
-				continue
-			}
-			if !timer.running {
-				instr.TestFailure(fmt.Errorf("timer %s existed, but was not currently started", label))
-				continue
-			}
+// launchPuppet starts the sbot of p with the implementation langImpl, and waits until it answers. if p was started with
+// a known identity, i.e. from the fixtures or a seed, the sbot has to come up with that identity
+func (s Simulator) launchPuppet(instr Instruction, p *Puppet, langImpl string, sleeper *Sleeper) error {
+	subfolder := fmt.Sprintf("%s-%s", langImpl, p.name)
+	fullpath := filepath.Join(s.puppetDir, subfolder)
+	p.port = s.acquirePort()
+	p.directory = fullpath
+	p.implementation = langImpl
+	if p.identitySeed != "" && !p.usesFixtures() {
+		feedID, err := s.writeIdentity(p)
+		if err != nil {
+			return fmt.Errorf("%s errored while writing its identity (%w)", p.name, err)
+		}
+		p.feedID = feedID
+	}
 
-			timer.elapsed += time.Since(timer.start)
-			timer.running = false
-			instr.TestSuccess()
-			taplog(fmt.Sprintf("timer %s stopped, current time: %s", label, timer.elapsed.Truncate(time.Millisecond)))
-		case "wait":
-			arg := s.getInstructionArg(1)
-			ms, err := time.ParseDuration(fmt.Sprintf("%sms", arg))
-			if err != nil {
-				instr.TestFailure(err)
-				continue
+	err := p.start(s, langImpl)
+	p.lastStart = time.Now()
+	if err != nil {
+		return launchFailure{err: err}
+	}
+	// give the sbot process some time to start
+	sleeper.sleep(2 * time.Second)
+
+	// a retry loop that tries to ping puppet's sbot, exits when ok or max retries reached
+	const MAX_RETRIES = 15
+	var feedID string
+	for retries := 0; retries < MAX_RETRIES; retries++ {
+		feedID, err = DoWhoami(p)
+		if err == nil {
+			break
+		} else {
+			if s.isCanceled() {
+				return errCanceled
 			}
-			sleeper.sleep(ms)
-			instr.TestSuccess()
-		case "waituntil":
-			line := s.getInstructionArg(2)
-			arg := strings.Split(line, "@")
-			if len(arg) < 2 {
-				s.Abort(fmt.Errorf("waituntil statement was missing @<seqno> (%s)", line))
-				return
+			instr.retried()
+			instr.taplog(fmt.Sprintf("waiting for %s sbot to start; retry %d/%d", p.name, retries, MAX_RETRIES))
+			if s.verbose {
+				instr.taplog(fmt.Sprintf("%s", err))
 			}
-			dst, seq := arg[0], arg[1]
-			srcPuppet := s.getSrcPuppet()
-			dstPuppet := s.getPuppet(dst)
-			MAX_RETRIES := 10
-			var err error
-			var message string
-			// kludge: we've been having rare issues of go-muxrpc failing on the waituntil command.  this kludge simply
-			// retries any failures, as the call is generally likely to succeed. typically, we only saw a failure once in a
-			// ~416 line netsim test.
-			for retries := 0; retries < MAX_RETRIES; retries++ {
-				message, err = DoWaitUntil(srcPuppet, dstPuppet, seq)
-				if err == nil {
-					break
-				} else {
-					if s.isCanceled() {
-						return
+			sleeper.sleep(5 * time.Second)
+		}
+	}
+
+	// if we still have an error after going through the retries, it's time to abort
+	// cause somethin' aint workin
+	if err != nil {
+		return fmt.Errorf("%s errored during start (%w)", p.name, err)
+	}
+
+	// if running with fixtures or a seeded identity: validate feedID matches the one the puppet was started with
+	if p.usesFixtures() || p.secret != "" {
+		if p.feedID != feedID && !p.usesFixtures() {
+			return fmt.Errorf("%s feed id was expected as %s, was %s; does %s's sim-shim.sh copy $SECRET into the puppet's directory?", p.name, p.feedID, feedID, langImpl)
+		}
+		if p.feedID != feedID {
+			return fmt.Errorf("%s feed id was expected as %s, was %s", p.name, p.feedID, feedID)
+		}
+	} else {
+		p.feedID = feedID
+	}
+
+	err = p.countMessages()
+	if err != nil {
+		return launchFailure{err: err}
+	}
+	return nil
+}
+
+// timedStep executes a single instruction, and records how long it took
+func (s Simulator) timedStep(instr Instruction, sleeper *Sleeper) error {
+	start := time.Now()
+	err := s.step(instr, sleeper)
+	if instr.result != nil {
+		instr.result.setDuration(time.Since(start))
+	}
+	for _, note := range s.drainNotes() {
+		instr.taplog(note)
+	}
+	return err
+}
+
+// drainNotes returns the notes raised about any of the puppets since they were last drained
+func (s Simulator) drainNotes() []string {
+	var notes []string
+	for _, p := range s.sortedPuppets() {
+		notes = append(notes, p.notes.drain()...)
+	}
+	return notes
+}
+
+// abortError pins an error which aborts the simulation to the instruction that caused it
+type abortError struct {
+	instr Instruction
+	err   error
+}
+
+func (a abortError) Error() string {
+	return a.err.Error()
+}
+
+// executeParallel runs every instruction between the `parallel` instruction at index start and its matching `end`,
+// each on its own goroutine. the output of each instruction is recorded, and replayed in line order once all of them
+// are done. it returns the index of the block's `end` instruction
+func (s Simulator) executeParallel(start int, sleeper *Sleeper) (int, error) {
+	end := -1
+	for i := start + 1; i < len(s.instructions); i++ {
+		if s.instructions[i].command == "end" {
+			end = i
+			break
+		}
+	}
+	if end == -1 {
+		return start, errors.New("parallel block is missing its `end`")
+	}
+	s.instructions[start].TestSuccess()
+
+	block := s.instructions[start+1 : end]
+	outputs := make([]recorder, len(block))
+	sleepers := make([]*Sleeper, len(block))
+	g := new(errgroup.Group)
+	for i := range block {
+		instr := block[i]
+		instr.output = &outputs[i]
+		sleepers[i] = sleeper.fork()
+		branchSleeper := sleepers[i]
+		g.Go(func() (err error) {
+			if s.interactive {
+				// Abort panics in netsim repl, which only recovers on its own goroutine. the abort has been reported
+				// already, so all that's left is to stop executing the rest of the input
+				defer func() {
+					if r := recover(); r != nil {
+						if _, ok := r.(interactiveAbort); !ok {
+							panic(r)
+						}
+						err = errCanceled
 					}
-					taplog(fmt.Sprintf("waituntil had an error on attempt %d/%d (%s) ", retries, MAX_RETRIES, err))
-					sleeper.sleep(1 * time.Second)
-				}
-			}
-			s.evaluateRun(err)
-			if err == nil {
-				// the message we get back is of the type "interpreting <name>@latest as <name>@<seqno>"
-				taplog(message)
-			}
-		case "unfollow":
-			fallthrough
-		case "follow":
-			srcPuppet := s.getSrcPuppet()
-			dstPuppet := s.getDstPuppet()
-			// TODO: check id and err if id not set
-			err := DoFollow(srcPuppet, dstPuppet, instr.command == "follow")
-			s.evaluateRun(err)
-			srcPuppet.bumpSeqno()
-		case "isfollowing":
-			srcPuppet := s.getSrcPuppet()
-			dstPuppet := s.getDstPuppet()
-			err := DoIsFollowing(srcPuppet, dstPuppet)
-			s.evaluateRun(err)
-		case "isnotfollowing":
-			srcPuppet := s.getSrcPuppet()
-			dstPuppet := s.getDstPuppet()
-			err := DoIsNotFollowing(srcPuppet, dstPuppet)
-			s.evaluateRun(err)
-		case "post":
-			srcPuppet := s.getSrcPuppet()
-			err := DoPost(srcPuppet)
-			s.evaluateRun(err)
-			srcPuppet.bumpSeqno()
-		case "publish":
-			postline := strings.Join(instr.args[1:], " ")
-			obj := parser.ParsePostLine(postline)
-			srcPuppet := s.getSrcPuppet()
-			err := DoPublish(srcPuppet, obj)
-			s.evaluateRun(err)
-			srcPuppet.bumpSeqno()
-		case "disconnect":
-			srcPuppet := s.getSrcPuppet()
-			dstPuppet := s.getDstPuppet()
-			err := DoDisconnect(srcPuppet, dstPuppet)
-			s.evaluateRun(err)
-		case "connect":
-			srcPuppet := s.getSrcPuppet()
-			dstPuppet := s.getDstPuppet()
-			err := DoConnect(srcPuppet, dstPuppet)
-			// TODO: re-evaluate need of sleeping after connection
-			// current need: make sure no puppet tries to hit the remote sbot too quickly (saw some error with like EOF
-			// something something)
-			sleeper.sleep(500 * time.Millisecond)
-			s.evaluateRun(err)
-		case "has":
-			line := s.getInstructionArg(2)
-			arg := strings.Split(line, "@")
-			if len(arg) < 2 {
-				s.Abort(fmt.Errorf("has statement was missing @<seqno> (%s)", line))
-				return
+				}()
 			}
-			dst, seq := arg[0], arg[1]
-			srcPuppet := s.getSrcPuppet()
-			dstPuppet := s.getPuppet(dst)
-			message, err := DoHast(srcPuppet, dstPuppet, seq)
-			s.evaluateRun(err)
-			if err == nil {
-				// the message we get back is of the type "interpreting <name>@latest as <name>@<seqno>"
-				taplog(message)
+			// each branch gets its own copy of the simulator, so that it can keep track of its own current instruction
+			branch := s
+			branch.updateCurrentInstruction(instr)
+			err = branch.timedStep(instr, branchSleeper)
+			if err != nil && !errors.Is(err, errCanceled) {
+				return abortError{instr: instr, err: err}
 			}
-		default:
-			// unknown command, abort test run
-			s.Abort(errors.New("Unknown simulator command"))
-			continue
-		}
+			return err
+		})
+	}
+	err := g.Wait()
+	for i := range outputs {
+		outputs[i].replay(defaultReporter)
+	}
+	sleeper.join(sleepers)
+	if err != nil {
+		return end, err
 	}
-	fmt.Printf("1..%d\n", len(s.instructions))
 
-	elapsed := time.Since(start)
-	var t time.Time
-	t = t.Add(elapsed)
-	cpuTime := t.Sub(sleeper.elapsed)
+	s.updateCurrentInstruction(s.instructions[end])
+	s.instructions[end].TestSuccess()
+	return end, nil
+}
 
-	taplog("End of simulation")
-	taplog(fmt.Sprintf("Total time: %s", elapsed.String()))
-	taplog(fmt.Sprintf("Active time: %s", cpuTime.String()))
-	taplog(fmt.Sprintf("Puppet count: %d", len(s.puppetMap)))
+// interactiveAbort is raised by Abort in netsim repl, in place of ending the simulation. the repl recovers it, and
+// carries on with the next statement it's given
+type interactiveAbort struct {
+	err error
 }
 
 func (s Simulator) Abort(err error) {
 	s.instr.TestAbort(err)
+	if s.interactive {
+		panic(interactiveAbort{err: err})
+	}
 	s.exit()
 }
 
-func (s Simulator) getPuppet(name string) *Puppet {
+// getPuppet returns the named puppet. the linter catches names used before their `enter`, but the puppet can still be
+// missing at runtime, e.g. if it's entered by a sibling branch of a parallel block
+func (s Simulator) getPuppet(name string) (*Puppet, error) {
+	s.mu.Lock()
 	p, exists := s.puppetMap[name]
+	s.mu.Unlock()
 	if !exists {
-		s.Abort(errors.New(fmt.Sprintf("fatal: there is no puppet declared as %s\n# possible fix: add `enter %s` before other statements", name, name)))
+		return nil, fmt.Errorf("fatal: there is no puppet declared as %s\n# possible fix: add `enter %s` before other statements", name, name)
 	}
-	return p
+	return p, nil
+}
+
+// convergedPuppets returns the puppets named by the arguments of converged, where * stands for all running puppets
+func (s Simulator) convergedPuppets(names []string) ([]*Puppet, error) {
+	if len(names) == 1 && names[0] == "*" {
+		var puppets []*Puppet
+		s.mu.Lock()
+		for _, p := range s.puppetMap {
+			if p.isExecuting() {
+				puppets = append(puppets, p)
+			}
+		}
+		s.mu.Unlock()
+		sort.Slice(puppets, func(i, j int) bool {
+			return puppets[i].name < puppets[j].name
+		})
+		return puppets, nil
+	}
+	puppets := make([]*Puppet, 0, len(names))
+	for _, name := range names {
+		p, err := s.getPuppet(name)
+		if err != nil {
+			return nil, err
+		}
+		puppets = append(puppets, p)
+	}
+	return puppets, nil
 }
 
-func (s Simulator) monitorInterrupts() {
-	c := make(chan os.Signal)
+// monitorInterrupts stops the simulation on ctrl-c, until the returned function is called
+func (s Simulator) monitorInterrupts() func() {
+	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		sig := <-c
-		taplog(fmt.Sprintf("received shutdown signal, shutting down (signal %s)\n", sig.String()))
-		s.cancelExecution()
+		select {
+		case sig := <-c:
+			taplog(fmt.Sprintf("received shutdown signal, shutting down (signal %s)\n", sig.String()))
+			s.report.setInterrupted()
+			s.killPuppets()
+			s.cancelExecution()
+		case <-done:
+		}
 	}()
+	return func() {
+		signal.Stop(c)
+		close(done)
+	}
+}
+
+// crashedPuppet returns the puppet whose sbot instr is executed against, if that sbot has crashed
+func (s Simulator) crashedPuppet(instr Instruction) *Puppet {
+	if _, ok := commandMethods[instr.command]; !ok || len(instr.args) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, exists := s.puppetMap[instr.args[0]]; exists && p.crashed() {
+		return p
+	}
+	return nil
+}
+
+// killPuppets kills the process groups of all running puppets
+func (s Simulator) killPuppets() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, puppet := range s.puppetMap {
+		if puppet.process != nil {
+			puppet.process.kill()
+		}
+	}
 }
 
 func (s Simulator) logMetrics() {
-	fmtString := "%-12s %12s %12s %12s %8s"
-	taplog(fmt.Sprintf(fmtString, "Puppet", "Total time", "Active time", "# messages", "# feeds"))
+	fmtString := "%-12s %12s %12s %12s %8s %12s %14s"
+	taplog(fmt.Sprintf(fmtString, "Puppet", "Total time", "Active time", "# messages", "# feeds", "# handshakes", "Handshake time"))
 	puppets := make([]*Puppet, 0, len(s.puppetMap))
 	// put all puppets into a slice so for later sortability, and stop the timers of running puppets
 	for _, puppet := range s.puppetMap {
@@ -688,8 +1364,11 @@ func (s Simulator) logMetrics() {
 		active := (puppet.totalTime - puppet.slept).Truncate(time.Millisecond)
 		msgcount := strconv.Itoa(puppet.totalMessages)
 		feedcount := strconv.Itoa(puppet.totalFeeds)
-		taplog(fmt.Sprintf(fmtString, puppet.name, total, active, msgcount, feedcount))
+		handshakes := strconv.Itoa(puppet.rpc.handshakes)
+		handshakeTime := puppet.rpc.handshakeTime.Truncate(time.Millisecond)
+		taplog(fmt.Sprintf(fmtString, puppet.name, total, active, msgcount, feedcount, handshakes, handshakeTime))
 	}
+	logResources(puppets)
 	// print timers if applicable
 	if len(s.timers) > 0 {
 		taplog("\nStarted timers & final elapsed time")
@@ -708,16 +1387,41 @@ func (s Simulator) logMetrics() {
 			taplog(fmt.Sprintf(fmtString, label, timer.elapsed.Truncate(time.Millisecond)))
 		}
 	}
+	// print the traffic that was relayed between puppets, and persist it for later comparisons
+	traffic := s.network.trafficReport()
+	logTraffic(traffic)
+	s.report.setPuppets(puppets)
+	s.report.setTimers(s.timers)
+	s.report.setTraffic(traffic)
+	err := writeTrafficReport(traffic, s.puppetDir)
+	if err != nil {
+		taplog(fmt.Sprintf("failed to write traffic report (%s)", err))
+	}
 }
 
 func (s Simulator) exit() {
+	if s.sampler != nil {
+		s.sampler.stop()
+	}
 	s.logMetrics()
+	if s.reportPath != "" {
+		err := s.report.write(s.reportPath)
+		if err != nil {
+			taplog(fmt.Sprintf("failed to write report to %s (%s)", s.reportPath, err))
+		}
+	}
 	taplog("Closing all puppets")
+	for _, puppet := range s.puppetMap {
+		puppet.rpc.close()
+	}
+	s.killPuppets()
+	s.network.close()
+	defaultReporter.Finish()
 	s.cancelExecution()
 	time.Sleep(1 * time.Second)
 }
 
-func preparePuppetDir(dir string) string {
+func puppetDirPath(dir string) string {
 	// introduce convention that the output dir is called puppets.
 	// this fixes edgecases of accidentally removing unintended
 	// folders + files
@@ -728,8 +1432,15 @@ func preparePuppetDir(dir string) string {
 	if err != nil {
 		log.Fatalln(err)
 	}
+	return absdir
+}
+
+func preparePuppetDir(dir string) string {
+	absdir := puppetDirPath(dir)
+	// puppets left running by a previous run would otherwise hold on to their ports
+	killOrphans(absdir)
 	// remove the puppet dir and its subfolders
-	err = os.RemoveAll(absdir)
+	err := os.RemoveAll(absdir)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -741,7 +1452,29 @@ func preparePuppetDir(dir string) string {
 	return absdir
 }
 
-func Run(args Args, sbots []string) {
+// Run executes the test of args against the sbots, returning the report of the run
+func Run(args Args, sbots []string) *Report {
+	args.Outdir = puppetDirPath(args.Outdir)
+	reporter, err := newReporter(args.Format, os.Stdout, filepath.Base(args.Testfile), args.Outdir)
+	if err != nil {
+		bail(err.Error())
+	}
+	defaultReporter = reporter
+	defaultReporter.Start()
+	preparePuppetDir(args.Outdir)
+
+	lines := readTest(args.Testfile)
+	roles, err := bindRoles(findRoles(lines), implementationNames(sbots))
+	if err != nil {
+		bail(err.Error())
+	}
+	return simulate(args, sbots, lines, roles, nil)
+}
+
+// simulate runs the test in lines, with its implementation roles bound to roles. args.Outdir must already exist.
+// ports continues the port counter of a previous run, so that consecutive runs don't reuse each other's ports; if nil,
+// the puppets' ports start at args.BasePort
+func simulate(args Args, sbots []string, lines []statement, roles map[string]string, ports *int) *Report {
 	// validate flag-passed caps key
 	_, err := base64.StdEncoding.DecodeString(args.Caps)
 	if err != nil {
@@ -761,16 +1494,53 @@ func Run(args Args, sbots []string) {
 	 *   some way to instantiate seeded secrets for each puppet
 	 */
 
-	args.Outdir = preparePuppetDir(args.Outdir)
 	sim := makeSimulator(args, sbots)
+	sim.report.Config.Roles = roles
+	if ports != nil {
+		sim.portCounter = ports
+	}
 	// monitor system interrupts via cmd-c/mod-c
-	sim.monitorInterrupts()
+	stopMonitoring := sim.monitorInterrupts()
+	defer stopMonitoring()
 
-	fmt.Println("TAP version 13")
-	lines := readTest(args.Testfile)
-	sim.ParseTest(lines)
+	sim.parseStatements(args.Testfile, lines, roles)
+	var declared map[string]bool
+	if args.FromSnapshot != "" {
+		manifest, err := sim.readSnapshot(args.FromSnapshot)
+		if err != nil {
+			bail(fmt.Sprintf("--from-snapshot: %s", err))
+		}
+		declared = manifest.names()
+	}
+	// catch mistakes in the test before spending any time on running it
+	if problems := sim.lint(declared); len(problems) > 0 {
+		for _, problem := range problems {
+			taplog(problem)
+		}
+		bail(fmt.Sprintf("found %d problems in %s; see `netsim lint`", len(problems), args.Testfile))
+	}
+	if args.SampleInterval > 0 {
+		path := args.Samples
+		if path == "" {
+			path = filepath.Join(args.Outdir, "samples.csv")
+		}
+		sampler, err := newSampler(sim, args.SampleInterval, path)
+		if err != nil {
+			bail(fmt.Sprintf("could not create samples file (%s)", err))
+		}
+		sim.sampler = sampler
+		sampler.start()
+	}
+	if args.FromSnapshot != "" {
+		if err := sim.restoreFrom(args.FromSnapshot); err != nil {
+			defaultReporter.Bail(fmt.Sprintf("--from-snapshot: %s", err))
+			sim.exit()
+			return sim.report
+		}
+	}
 	sim.execute()
 
 	// once we are done we want all puppets to exit
 	sim.exit()
+	return sim.report
 }
@@ -0,0 +1,260 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+ * the test language has a few parse-time abstractions, which are expanded into plain statements before the simulation
+ * starts:
+ *
+ *   set n 50                     defines the variable $n (or ${n}) for all of the following lines
+ *   repeat $n {                  repeats its body n times
+ *     post alice
+ *   }
+ *   for p in alice bob {         repeats its body once for each item, with $p set to the item
+ *     start $p ssb-server
+ *   }
+ *   define sync(a, b) {          defines the macro sync, which is then used like any other command: `sync alice bob`
+ *     connect $a $b
+ *     waituntil $a $b@latest
+ *     disconnect $a $b
+ *   }
+ *
+ * blocks may be nested, and a block with a single statement may be written on one line: `repeat 50 { post alice }`.
+ * every expanded statement keeps the position (file:line) it was written at, for reporting
+ */
+
+// statement is a single line of a test, and the position it was written at
+type statement struct {
+	text string
+	file string // empty if the statements weren't read from a file
+	line int
+}
+
+// pos formats the position of the statement as file:line
+func (s statement) pos() string {
+	if s.file == "" {
+		return fmt.Sprintf("line %d", s.line)
+	}
+	return fmt.Sprintf("%s:%d", s.file, s.line)
+}
+
+// at returns a statement with the passed in text, at the position of s
+func (s statement) at(text string) statement {
+	return statement{text: text, file: s.file, line: s.line}
+}
+
+// node is a plain statement, or a block statement (repeat, for, define) with its body
+type node struct {
+	statement
+	keyword string // repeat, for or define; empty for plain statements
+	body    []node
+}
+
+type macro struct {
+	params []string
+	body   []node
+}
+
+// the maximum depth of nested macro invocations, to catch macros which invoke themselves
+const maxMacroDepth = 64
+
+var (
+	variablePattern = regexp.MustCompile(`\$\{(\w+)\}|\$(\w+)`)
+	definePattern   = regexp.MustCompile(`^define\s+([\w-]+)\s*(?:\(([^)]*)\))?$`)
+	setPattern      = regexp.MustCompile(`^set\s+(\w+)\s+(.*\S)\s*$`)
+)
+
+// expandTest expands the variables, loops and macros of lines, returning the plain statements to execute. vars are
+// predefined variables, such as the implementation roles bound by netsim, which the test may still redefine with `set`
+func expandTest(lines []statement, vars map[string]string) ([]statement, error) {
+	return newExpander(vars).expandLines(lines)
+}
+
+func newExpander(vars map[string]string) *expander {
+	e := &expander{vars: make(map[string]string), macros: make(map[string]macro)}
+	for name, value := range vars {
+		e.vars[name] = value
+	}
+	return e
+}
+
+// expandLines expands lines into plain statements. the variables & macros they define are kept by the expander, for
+// any lines expanded after them
+func (e *expander) expandLines(lines []statement) ([]statement, error) {
+	nodes, rest, err := parseBlock(lines, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("%s: `}` without a matching block", rest[0].pos())
+	}
+	e.out = nil
+	err = e.expand(nodes, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return e.out, nil
+}
+
+// parseBlock groups lines into nodes, until it hits the `}` closing the current block (returned as the first of the
+// remaining lines) or runs out of lines
+func parseBlock(lines []statement, depth int) ([]node, []statement, error) {
+	var nodes []node
+	for len(lines) > 0 {
+		stmt := lines[0]
+		text := strings.TrimSpace(stmt.text)
+		if text == "}" {
+			if depth == 0 {
+				return nil, nil, fmt.Errorf("%s: `}` without a matching block", stmt.pos())
+			}
+			return nodes, lines, nil
+		}
+		keyword := strings.Fields(text)[0]
+		isBlock := (keyword == "repeat" || keyword == "for" || keyword == "define") && strings.Contains(text, "{")
+		if !isBlock {
+			nodes = append(nodes, node{statement: stmt.at(text)})
+			lines = lines[1:]
+			continue
+		}
+
+		open := strings.Index(text, "{")
+		n := node{statement: stmt.at(strings.TrimSpace(text[:open])), keyword: keyword}
+		inline := strings.TrimSpace(text[open+1:])
+		lines = lines[1:]
+		if inline != "" {
+			// one-line block: `repeat 50 { post alice }`
+			if !strings.HasSuffix(inline, "}") {
+				return nil, nil, fmt.Errorf("%s: expected the block to end with `}` on the same line", stmt.pos())
+			}
+			inline = strings.TrimSpace(strings.TrimSuffix(inline, "}"))
+			if inline == "" {
+				return nil, nil, fmt.Errorf("%s: the block was empty", stmt.pos())
+			}
+			n.body = []node{{statement: stmt.at(inline)}}
+			nodes = append(nodes, n)
+			continue
+		}
+
+		body, rest, err := parseBlock(lines, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rest) == 0 {
+			return nil, nil, fmt.Errorf("%s: %s block is missing its closing `}`", stmt.pos(), keyword)
+		}
+		n.body = body
+		nodes = append(nodes, n)
+		lines = rest[1:]
+	}
+	return nodes, nil, nil
+}
+
+type expander struct {
+	vars   map[string]string // variables defined with `set`
+	macros map[string]macro
+	out    []statement
+}
+
+// substitute replaces the variables in str. the variables in scope (loop variables & macro parameters) shadow those
+// defined with `set`. unknown variables are left as they are
+func (e *expander) substitute(str string, scope map[string]string) string {
+	return variablePattern.ReplaceAllStringFunc(str, func(match string) string {
+		groups := variablePattern.FindStringSubmatch(match)
+		name := groups[1] + groups[2]
+		if value, ok := scope[name]; ok {
+			return value
+		}
+		if value, ok := e.vars[name]; ok {
+			return value
+		}
+		return match
+	})
+}
+
+func (e *expander) expand(nodes []node, scope map[string]string, depth int) error {
+	for _, n := range nodes {
+		text := e.substitute(n.text, scope)
+		fields := strings.Fields(strings.ReplaceAll(text, ",", " "))
+		switch n.keyword {
+		case "repeat":
+			if len(fields) != 2 {
+				return fmt.Errorf("%s: expected `repeat <count> {`", n.pos())
+			}
+			count, err := strconv.Atoi(fields[1])
+			if err != nil || count < 0 {
+				return fmt.Errorf("%s: repeat count %q was not a non-negative number", n.pos(), fields[1])
+			}
+			for i := 0; i < count; i++ {
+				if err := e.expand(n.body, scope, depth); err != nil {
+					return err
+				}
+			}
+		case "for":
+			if len(fields) < 3 || fields[2] != "in" {
+				return fmt.Errorf("%s: expected `for <variable> in <item> <item>... {`", n.pos())
+			}
+			for _, item := range fields[3:] {
+				inner := withBinding(scope, fields[1], item)
+				if err := e.expand(n.body, inner, depth); err != nil {
+					return err
+				}
+			}
+		case "define":
+			matches := definePattern.FindStringSubmatch(n.text)
+			if matches == nil {
+				return fmt.Errorf("%s: expected `define <name>(<param>, <param>...) {`", n.pos())
+			}
+			e.macros[matches[1]] = macro{params: strings.Fields(strings.ReplaceAll(matches[2], ",", " ")), body: n.body}
+		default:
+			if fields[0] == "set" {
+				// the value is the rest of the line, so that it may contain spaces
+				matches := setPattern.FindStringSubmatch(text)
+				if matches == nil {
+					return fmt.Errorf("%s: expected `set <variable> <value>`", n.pos())
+				}
+				e.vars[matches[1]] = matches[2]
+				continue
+			}
+			m, isMacro := e.macros[fields[0]]
+			if !isMacro {
+				e.out = append(e.out, n.at(text))
+				continue
+			}
+			args := fields[1:]
+			if len(args) != len(m.params) {
+				return fmt.Errorf("%s: %s expects %d arguments (%s), got %d", n.pos(), fields[0], len(m.params), strings.Join(m.params, ", "), len(args))
+			}
+			if depth >= maxMacroDepth {
+				return fmt.Errorf("%s: macros were nested more than %d levels deep; does %s invoke itself?", n.pos(), maxMacroDepth, fields[0])
+			}
+			// macro bodies only see their own parameters, and the variables defined with `set`
+			params := make(map[string]string)
+			for i, param := range m.params {
+				params[param] = args[i]
+			}
+			if err := e.expand(m.body, params, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// withBinding returns a copy of scope, with name bound to value
+func withBinding(scope map[string]string, name, value string) map[string]string {
+	inner := make(map[string]string, len(scope)+1)
+	for k, v := range scope {
+		inner[k] = v
+	}
+	inner[name] = value
+	return inner
+}
@@ -0,0 +1,74 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func statements(test string) []statement {
+	var lines []statement
+	for i, line := range strings.Split(test, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		lines = append(lines, statement{text: line, line: i + 1})
+	}
+	return lines
+}
+
+func TestExpansion(t *testing.T) {
+	a := assert.New(t)
+
+	test := `
+set peer alice
+define sync(a, b) {
+  connect $a $b
+  waituntil $a $b@latest
+}
+repeat 2 { post $peer }
+for p in bob carol {
+  sync $peer $p
+}
+`
+	expanded, err := expandTest(statements(test), nil)
+	a.NoError(err)
+	a.Equal([]statement{
+		{text: "post alice", line: 7},
+		{text: "post alice", line: 7},
+		{text: "connect alice bob", line: 4},
+		{text: "waituntil alice bob@latest", line: 5},
+		{text: "connect alice carol", line: 4},
+		{text: "waituntil alice carol@latest", line: 5},
+	}, expanded)
+
+	// an empty repeat is allowed, e.g. for a count set by a variable
+	expanded, err = expandTest(statements("set n 0\nrepeat $n { post alice }\npost bob"), nil)
+	a.NoError(err)
+	a.Equal([]statement{{text: "post bob", line: 3}}, expanded)
+}
+
+func TestExpansionErrors(t *testing.T) {
+	a := assert.New(t)
+
+	var cases = map[string]string{
+		"repeat 2 {\npost alice":                 "line 1: repeat block is missing its closing `}`",
+		"post alice\n}":                          "line 2: `}` without a matching block",
+		"repeat many { post alice }":             `line 1: repeat count "many" was not a non-negative number`,
+		"repeat -1 { post alice }":               `line 1: repeat count "-1" was not a non-negative number`,
+		"define f(a) { post $a }\nf alice bob":   "line 2: f expects 1 arguments (a), got 2",
+		"define loop(a) { loop $a }\nloop alice": "line 1: macros were nested more than 64 levels deep; does loop invoke itself?",
+		"for p bob carol {\npost $p\n}":          "line 1: expected `for <variable> in <item> <item>... {`",
+	}
+
+	for test, msg := range cases {
+		_, err := expandTest(statements(test), nil)
+		a.EqualError(err, msg, test)
+	}
+}
@@ -0,0 +1,49 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/ssb-ngi-pointer/netsim/internal/keys"
+)
+
+// seededKeyPair derives the keypair of the named puppet from seed, so that the puppet gets the same feed id in every
+// run that uses the same seed. puppets sharing a seed still get keypairs of their own
+func seededKeyPair(seed, name string) (*keys.KeyPair, error) {
+	// the length prefix keeps e.g. seed "a b" & name "c" apart from seed "a" & name "b c"
+	sum := sha256.Sum256([]byte(fmt.Sprintf("netsim identity %d:%s:%s", len(seed), seed, name)))
+	return keys.NewKeyPair(bytes.NewReader(sum[:]))
+}
+
+// identityPath is where the secret of p's seeded identity is written. it's kept out of the puppet's ssb directory,
+// which the shims copy $SECRET into, and which `reset` removes
+func (s Simulator) identityPath(p *Puppet) string {
+	return filepath.Join(s.puppetDir, "identities", p.name, "secret")
+}
+
+// writeIdentity writes the secret of p's seeded identity, for its shim to pick up as $SECRET, and returns the feed id
+// of the identity
+func (s Simulator) writeIdentity(p *Puppet) (string, error) {
+	kp, err := seededKeyPair(p.identitySeed, p.name)
+	if err != nil {
+		return "", err
+	}
+	path := s.identityPath(p)
+	// the secret is written anew on every start, in case the seed changed while the puppet was stopped
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	if err := keys.SaveKeyPair(*kp, path); err != nil {
+		return "", err
+	}
+	p.secret = path
+	return kp.Feed.String(), nil
+}
@@ -0,0 +1,55 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"io"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/ssb-ngi-pointer/netsim/internal/keys"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeededIdentity(t *testing.T) {
+	a := assert.New(t)
+
+	alice, err := seededKeyPair("42", "alice")
+	a.NoError(err)
+	again, err := seededKeyPair("42", "alice")
+	a.NoError(err)
+	a.Equal(alice.Feed.String(), again.Feed.String())
+	bob, err := seededKeyPair("42", "bob")
+	a.NoError(err)
+	a.NotEqual(alice.Feed.String(), bob.Feed.String())
+	other, err := seededKeyPair("43", "alice")
+	a.NoError(err)
+	a.NotEqual(alice.Feed.String(), other.Feed.String())
+
+	s := Simulator{puppetDir: t.TempDir()}
+	p := &Puppet{name: "alice", identitySeed: "42"}
+	// writing the secret again, as on a restart, replaces it
+	for i := 0; i < 2; i++ {
+		feedID, err := s.writeIdentity(p)
+		a.NoError(err)
+		a.Equal(alice.Feed.String(), feedID)
+	}
+	kp, err := keys.LoadKeyPair(p.secret)
+	a.NoError(err)
+	a.Equal(alice.Feed.String(), kp.Feed.String())
+
+	// a puppet that was started before has a log of its old identity, which has to be reset first
+	s = Simulator{puppetMap: map[string]*Puppet{"alice": {name: "alice", directory: t.TempDir()}}, mu: new(sync.Mutex)}
+	identity := func() error {
+		s.instr = parseTestLine("identity alice 43", 1)
+		s.instr.output = newTAPReporter(io.Discard)
+		return s.step(s.instr, nil)
+	}
+	a.Error(identity())
+	a.NoError(os.RemoveAll(s.puppetMap["alice"].directory))
+	a.NoError(identity())
+	a.Equal("43", s.puppetMap["alice"].identitySeed)
+}
@@ -13,23 +13,80 @@ type Instruction struct {
 	args    []string
 	line    string
 	id      int
+	source  statement          // where in the test files the instruction was written
+	origin  string             // the position reported alongside the instruction; empty when it's simply line <id> of the test
+	output  Reporter           // where the outcome of the instruction is reported; the default reporter unless it's being recorded
+	result  *InstructionReport // where the outcome of the instruction is recorded for the run report
+}
+
+func (instr Instruction) reporter() Reporter {
+	if instr.output == nil {
+		return defaultReporter
+	}
+	return instr.output
+}
+
+// statement is the instruction as it is reported, along with the position it was written at if that's not obvious
+// from its id
+func (instr Instruction) statement() string {
+	if instr.origin == "" {
+		return instr.line
+	}
+	return fmt.Sprintf("%s (%s)", instr.line, instr.origin)
+}
+
+// position is where the instruction was written, as file:line
+func (instr Instruction) position() string {
+	if instr.source.line == 0 {
+		return fmt.Sprintf("line %d", instr.id)
+	}
+	return instr.source.pos()
 }
 
 func (instr Instruction) Print() {
-	taplog(fmt.Sprintf("%d %s", instr.id, instr.line))
+	instr.taplog(fmt.Sprintf("%d %s", instr.id, instr.line))
 }
 
 func (instr Instruction) TestSuccess() {
-	fmt.Printf("ok %d - %s\n", instr.id, instr.line)
+	instr.record(StatusOk, nil)
+	instr.reporter().Success(instr)
 }
 
 func (instr Instruction) TestFailure(err error) {
-	fmt.Printf("not ok %d - %s\n", instr.id, instr.line)
-	taplog(err.Error())
+	instr.record(StatusNotOk, err)
+	instr.reporter().Failure(instr, err)
+}
+
+// TestSkip reports that the instruction wasn't executed, and why
+func (instr Instruction) TestSkip(reason string) {
+	instr.record(StatusSkipped, nil)
+	if instr.result != nil {
+		instr.result.Error = reason
+	}
+	instr.reporter().Skip(instr, reason)
 }
 
 func (instr Instruction) TestAbort(err error) {
-	fmt.Printf("Bail out! %s (%s)\n", err.Error(), instr.line)
+	instr.record(StatusBailOut, err)
+	instr.reporter().Abort(instr, err)
+}
+
+func (instr Instruction) record(status string, err error) {
+	if instr.result != nil {
+		instr.result.setStatus(status, err)
+	}
+}
+
+// retried records that the instruction had to retry a failing call
+func (instr Instruction) retried() {
+	if instr.result != nil {
+		instr.result.Retries++
+	}
+}
+
+// taplog writes a diagnostic comment related to the instruction
+func (instr Instruction) taplog(str string) {
+	instr.reporter().Diagnostic(instr, str)
 }
 
 func (instr Instruction) getSrc() string {
@@ -46,14 +103,21 @@ func (instr Instruction) getDst() string {
 // aliases of getSrc/getDst for args that don't correlate to src & dst :)
 func (instr Instruction) first() (string, error) {
 	if len(instr.args) == 0 {
-		return "", fmt.Errorf("command was missing its first argument (%s:%d)", instr.line, instr.id)
+		return "", fmt.Errorf("command was missing its first argument (%s, %s)", instr.line, instr.position())
 	}
 	return instr.args[0], nil
 }
 
 func (instr Instruction) second() (string, error) {
 	if len(instr.args) < 2 {
-		return "", fmt.Errorf("%s was missing its second argument on line %d", instr.command, instr.id)
+		return "", fmt.Errorf("%s was missing its second argument on %s", instr.command, instr.position())
 	}
 	return instr.args[1], nil
 }
+
+func (instr Instruction) third() (string, error) {
+	if len(instr.args) < 3 {
+		return "", fmt.Errorf("%s was missing its third argument on %s", instr.command, instr.position())
+	}
+	return instr.args[2], nil
+}
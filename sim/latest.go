@@ -0,0 +1,191 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.cryptoscope.co/muxrpc/v2"
+)
+
+// latestStrategy is a way of asking a puppet for the latest sequence of every feed it stores. implementations differ
+// in which of the methods they support, so each puppet is probed for the cheapest one that works
+type latestStrategy struct {
+	name  string
+	query func(p *Puppet) ([]Latest, error)
+}
+
+// latestStrategies are ordered from cheapest to most expensive. the log stream scan works everywhere, and is used
+// when none of the others do
+var latestStrategies = []latestStrategy{
+	{name: "getVectorClock", query: vectorClockQuery(muxrpc.Method{"getVectorClock"}, nil)},
+	{name: "db.getVectorClock", query: vectorClockQuery(muxrpc.Method{"db", "getVectorClock"}, nil)},
+	{name: "ebt.clock", query: vectorClockQuery(muxrpc.Method{"ebt", "clock"}, map[string]string{"format": "classic"})},
+	{name: "replicate.upto", query: queryReplicateUpto},
+}
+
+var logStreamStrategy = latestStrategy{name: "createLogStream", query: func(p *Puppet) ([]Latest, error) {
+	return scanLogStream(p, "")
+}}
+
+// queryLatest returns the latest sequence of every feed stored by p
+func queryLatest(p *Puppet) ([]Latest, error) {
+	if strategy := p.rpc.latestStrategy(); strategy != nil {
+		return strategy.query(p)
+	}
+	return probeLatest(p)
+}
+
+// queryFeedLatest returns the latest sequence of a single feed stored by p. when p has to be scanned with
+// createLogStream, the scan stops at the feed's latest message
+func queryFeedLatest(p *Puppet, feedID string) (Latest, bool, error) {
+	var latest []Latest
+	var err error
+	switch strategy := p.rpc.latestStrategy(); {
+	case strategy == nil:
+		latest, err = probeLatest(p)
+	case strategy.name == logStreamStrategy.name:
+		latest, err = scanLogStream(p, feedID)
+	default:
+		latest, err = strategy.query(p)
+	}
+	if err != nil {
+		return Latest{}, false, err
+	}
+	l, has := getLatestByFeedID(latest, feedID)
+	return l, has, nil
+}
+
+// probeLatest tries each strategy in turn, and remembers the first one to answer for the rest of p's session. an
+// empty answer can't tell a method which doesn't work in p's implementation (e.g. replicate.upto on top of ssb-db2)
+// apart from an empty database, so a strategy is only settled on once p stores any messages
+func probeLatest(p *Puppet) ([]Latest, error) {
+	for i := range latestStrategies {
+		strategy := &latestStrategies[i]
+		latest, err := strategy.query(p)
+		if err == nil && len(latest) > 0 {
+			p.rpc.setLatestStrategy(p, strategy)
+			return latest, nil
+		}
+	}
+	latest, err := logStreamStrategy.query(p)
+	if err != nil {
+		return nil, err
+	}
+	if len(latest) > 0 {
+		p.rpc.setLatestStrategy(p, &logStreamStrategy)
+	}
+	return latest, nil
+}
+
+// vectorClockQuery queries a method answering with a {feed id: latest sequence} map
+func vectorClockQuery(method muxrpc.Method, opts interface{}) func(p *Puppet) ([]Latest, error) {
+	return func(p *Puppet) ([]Latest, error) {
+		var clock map[string]int
+		err := asyncRequest(p, method, &opts, &clock)
+		if err != nil {
+			return nil, err
+		}
+		var latest []Latest
+		for feed, seqno := range clock {
+			// ebt marks feeds it has been asked not to replicate with negative sequences
+			if seqno > 0 {
+				latest = append(latest, Latest{ID: feed, Sequence: seqno})
+			}
+		}
+		return latest, nil
+	}
+}
+
+// queryReplicateUpto streams {id, sequence, ts} for every stored feed
+func queryReplicateUpto(p *Puppet) ([]Latest, error) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	src, err := sourceRequest(ctx, p, muxrpc.Method{"replicate", "upto"}, map[string]interface{}{})
+	if err != nil {
+		return nil, err
+	}
+	var latest []Latest
+	for src.Next(ctx) {
+		var l Latest
+		err = src.Reader(func(rd io.Reader) error {
+			return json.NewDecoder(rd).Decode(&l)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if l.Sequence > 0 {
+			latest = append(latest, l)
+		}
+	}
+	if err := src.Err(); err != nil {
+		return nil, fmt.Errorf("replicate.upto failed: %w", err)
+	}
+	return latest, nil
+}
+
+// scanLogStream reads p's whole log, newest message first. as a feed's messages are appended in order, the first
+// message seen of each author is its latest. if feedID is set, the scan stops as soon as that feed's latest message
+// has been seen
+func scanLogStream(p *Puppet, feedID string) ([]Latest, error) {
+	type logStreamResponse struct {
+		Value struct {
+			Author    string `json:"author"`
+			Sequence  int    `json:"sequence"`
+			Timestamp int    `json:"timestamp"`
+		} `json:"value"`
+	}
+
+	type sourceOptions struct {
+		Reverse bool `json:"reverse"`
+		Keys    bool `json:"keys"`
+	}
+
+	// explicitly set the Keys property to make the go & js stacks return the data in the same format
+	opts := sourceOptions{Reverse: true, Keys: true}
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	src, err := sourceRequest(ctx, p, muxrpc.Method{"createLogStream"}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var latest []Latest
+	errFound := errors.New("found the feed")
+	for src.Next(ctx) {
+		// decode each message straight off the stream, without buffering it first
+		err = src.Reader(func(rd io.Reader) error {
+			var resp logStreamResponse
+			if err := json.NewDecoder(rd).Decode(&resp); err != nil {
+				return err
+			}
+			author := resp.Value.Author
+			if seen[author] {
+				return nil
+			}
+			seen[author] = true
+			latest = append(latest, Latest{ID: author, Sequence: resp.Value.Sequence, TS: resp.Value.Timestamp})
+			if author == feedID {
+				return errFound
+			}
+			return nil
+		})
+		if errors.Is(err, errFound) {
+			return latest, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := src.Err(); err != nil {
+		return nil, fmt.Errorf("createLogStream failed: %w", err)
+	}
+	return latest, nil
+}
@@ -0,0 +1,452 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// argType describes what an argument of a command has to look like
+type argType int
+
+const (
+	argName           argType = iota // the name of an entered puppet
+	argImplementation                // the folder name of an implementation passed to netsim
+	argNumber                        // a non-negative integer
+	argSeqno                         // <name>@latest or <name>@<seqno>
+	argCaps                          // a base64 encoded caps key
+	argFeedID                        // @<base64>.ed25519
+	argLatency                       // see parseLatency
+	argDroprate                      // see parseDroprate
+	argBandwidth                     // see parseBandwidth
+	argLabel                         // the label of a snapshot, see snapshotLabelPattern
+	argWord                          // anything, e.g. a timer label
+)
+
+// commandSpec is the signature of a command: the types of its arguments, and whether any number of additional
+// arguments (e.g. a message to publish) may follow
+type commandSpec struct {
+	args []argType
+	rest bool
+}
+
+// commandTable contains the signature of every command of the test language
+var commandTable = map[string]commandSpec{
+	"#":              {rest: true},
+	"comment":        {rest: true},
+	"enter":          {args: []argType{argWord}},
+	"load":           {args: []argType{argName, argFeedID}},
+	"identity":       {args: []argType{argName, argWord}},
+	"skipoffset":     {args: []argType{argName}},
+	"alloffsets":     {args: []argType{argName}},
+	"hops":           {args: []argType{argName, argNumber}},
+	"caps":           {args: []argType{argName, argCaps}},
+	"reset":          {args: []argType{argName, argImplementation}},
+	"start":          {args: []argType{argName, argImplementation}},
+	"stop":           {args: []argType{argName}},
+	"log":            {args: []argType{argName, argNumber}},
+	"timerstart":     {args: []argType{argWord}},
+	"timerstop":      {args: []argType{argWord}},
+	"wait":           {args: []argType{argNumber}},
+	"waituntil":      {args: []argType{argName, argSeqno}},
+	"follow":         {args: []argType{argName, argName}},
+	"unfollow":       {args: []argType{argName, argName}},
+	"isfollowing":    {args: []argType{argName, argName}},
+	"isnotfollowing": {args: []argType{argName, argName}},
+	"block":          {args: []argType{argName, argName}},
+	"unblock":        {args: []argType{argName, argName}},
+	"isblocked":      {args: []argType{argName, argName}},
+	"isnotblocked":   {args: []argType{argName, argName}},
+	"post":           {args: []argType{argName}},
+	"publish":        {args: []argType{argName, argWord}, rest: true},
+	"connect":        {args: []argType{argName, argName}},
+	"disconnect":     {args: []argType{argName, argName}},
+	"latency":        {args: []argType{argName, argName, argLatency}},
+	"droprate":       {args: []argType{argName, argName, argDroprate}},
+	"bandwidth":      {args: []argType{argName, argBandwidth}},
+	"partition":      {rest: true}, // the groups are checked separately, as they are parsed from the raw line
+	"heal":           {},
+	"has":            {args: []argType{argName, argSeqno}},
+	"hasmsg":         {args: []argType{argName, argSeqno}, rest: true},
+	"verifyfeed":     {args: []argType{argName, argName}},
+	"converged":      {rest: true}, // the names are checked separately, as the first may be +keys
+	"snapshot":       {args: []argType{argLabel}},
+	"restore":        {args: []argType{argLabel}},
+	"parallel":       {},
+	"end":            {},
+}
+
+var feedIDPattern = regexp.MustCompile(`^@[A-Za-z0-9+/]{43}=\.ed25519$`)
+
+// linter statically checks a test, before any puppet is started
+type linter struct {
+	implementations map[string]string // nil if the implementations are unknown, and shouldn't be checked
+	fixtures        string
+	fixturesIds     map[string]FixturesFeedInfo
+	declared        map[string]bool // puppets entered before the linted instructions, e.g. earlier in a repl session
+	snapshotDir     string          // where the snapshots restored by the test are looked up
+	entered         map[string]bool
+	snapshots       map[string]bool // labels of the snapshots taken by the test so far
+	undeclared      map[string]bool // names that have already been reported as not entered
+	problems        []string
+}
+
+func (l *linter) problem(instr Instruction, format string, a ...interface{}) {
+	l.problems = append(l.problems, fmt.Sprintf("%s: %s", instr.position(), fmt.Sprintf(format, a...)))
+}
+
+// lint checks every instruction, returning all of the problems that were found
+func (l *linter) lint(instructions []Instruction) []string {
+	l.entered = make(map[string]bool)
+	for name := range l.declared {
+		l.entered[name] = true
+	}
+	l.undeclared = make(map[string]bool)
+	l.snapshots = make(map[string]bool)
+	l.problems = nil
+	var parallel *Instruction
+	for i := range instructions {
+		instr := instructions[i]
+		spec, ok := commandTable[instr.command]
+		if !ok {
+			l.problem(instr, "unknown command %s%s", instr.command, suggest(instr.command, commandNames()))
+			continue
+		}
+		l.checkArity(instr, spec)
+
+		switch instr.command {
+		case "enter":
+			if len(instr.args) > 0 {
+				l.entered[instr.args[0]] = true
+			}
+		case "load":
+			l.checkLoad(instr)
+		case "snapshot":
+			l.checkSequential(instr, parallel)
+			if len(instr.args) > 0 {
+				l.snapshots[instr.args[0]] = true
+			}
+		case "restore":
+			l.checkSequential(instr, parallel)
+			l.checkRestore(instr)
+		case "publish":
+			if _, err := parseMessage(instr, 2); err != nil {
+				l.problem(instr, "%s", err)
+			}
+		case "hasmsg":
+			if _, err := parseMessage(instr, 3); err != nil {
+				l.problem(instr, "%s", err)
+			}
+		case "converged":
+			l.checkConverged(instr)
+		case "partition":
+			groups, err := parsePartitionGroups(instr.line)
+			if err != nil {
+				l.problem(instr, "%s", err)
+			}
+			for _, group := range groups {
+				for _, name := range group {
+					l.checkName(instr, name)
+				}
+			}
+		case "parallel":
+			if parallel != nil {
+				l.problem(instr, "parallel blocks can't be nested (the block opened on %s is still open)", parallel.position())
+			}
+			parallel = &instructions[i]
+		case "end":
+			if parallel == nil {
+				l.problem(instr, "end without a matching parallel")
+			}
+			parallel = nil
+		}
+
+		for j, arg := range instr.args {
+			if j >= len(spec.args) {
+				break
+			}
+			l.checkArg(instr, spec.args[j], arg)
+		}
+	}
+	if parallel != nil {
+		l.problem(*parallel, "parallel block is missing its `end`")
+	}
+	return l.problems
+}
+
+func (l *linter) checkArity(instr Instruction, spec commandSpec) {
+	got, want := len(instr.args), len(spec.args)
+	switch {
+	case got < want:
+		l.problem(instr, "%s expects %d arguments, got %d", instr.command, want, got)
+	case got > want && !spec.rest:
+		l.problem(instr, "%s expects %d arguments, got %d", instr.command, want, got)
+	}
+}
+
+func (l *linter) checkArg(instr Instruction, kind argType, arg string) {
+	switch kind {
+	case argName:
+		l.checkName(instr, arg)
+	case argImplementation:
+		if l.implementations == nil {
+			return
+		}
+		if _, ok := l.implementations[arg]; !ok {
+			l.problem(instr, "implementation %s was not passed to netsim%s", arg, suggest(arg, mapKeys(l.implementations)))
+		}
+	case argNumber:
+		if n, err := strconv.Atoi(arg); err != nil || n < 0 {
+			l.problem(instr, "%q was not a number", arg)
+		}
+	case argSeqno:
+		parts := strings.Split(arg, "@")
+		if len(parts) != 2 {
+			l.problem(instr, "%q should be <name>@latest or <name>@<seqno>", arg)
+			return
+		}
+		l.checkName(instr, parts[0])
+		if n, err := strconv.Atoi(parts[1]); parts[1] != "latest" && (err != nil || n < 0) {
+			l.problem(instr, "%q should be <name>@latest or <name>@<seqno>", arg)
+		}
+	case argCaps:
+		if _, err := base64.StdEncoding.DecodeString(arg); err != nil {
+			l.problem(instr, "caps %q was not a valid base64 sequence", arg)
+		}
+	case argFeedID:
+		if !feedIDPattern.MatchString(arg) {
+			l.problem(instr, "%q was not a feed id (@<base64>.ed25519)", arg)
+		}
+	case argLatency:
+		if _, err := parseLatency(arg); err != nil {
+			l.problem(instr, "%s", err)
+		}
+	case argDroprate:
+		if _, err := parseDroprate(arg); err != nil {
+			l.problem(instr, "%s", err)
+		}
+	case argBandwidth:
+		if _, err := parseBandwidth(arg); err != nil {
+			l.problem(instr, "%s", err)
+		}
+	case argLabel:
+		if !snapshotLabelPattern.MatchString(arg) {
+			l.problem(instr, "snapshot label %q may only contain letters, digits, _, - and .", arg)
+		}
+	}
+}
+
+// checkSequential makes sure that instr, which stops & starts every puppet, isn't run alongside the other statements
+// of the parallel block, if any, it's in
+func (l *linter) checkSequential(instr Instruction, parallel *Instruction) {
+	if parallel != nil {
+		l.problem(instr, "%s stops & starts every puppet, and can't be part of the parallel block opened on %s", instr.command, parallel.position())
+	}
+}
+
+// checkRestore makes sure that the restored snapshot exists, or is taken earlier in the test. the puppets of an
+// existing snapshot count as entered from then on
+func (l *linter) checkRestore(instr Instruction) {
+	if len(instr.args) == 0 || l.snapshots[instr.args[0]] || !snapshotLabelPattern.MatchString(instr.args[0]) {
+		return
+	}
+	manifest, err := readSnapshotManifest(l.snapshotDir, instr.args[0])
+	if err != nil {
+		l.problem(instr, "%s", err)
+		return
+	}
+	for _, snap := range manifest.Puppets {
+		l.entered[snap.Name] = true
+	}
+}
+
+// checkName makes sure that the puppet name has been entered before it's used. each undeclared name is only reported
+// the first time it's used
+func (l *linter) checkName(instr Instruction, name string) {
+	if !l.entered[name] && !l.undeclared[name] {
+		l.undeclared[name] = true
+		entered := make([]string, 0, len(l.entered))
+		for n := range l.entered {
+			entered = append(entered, n)
+		}
+		l.problem(instr, "there is no puppet declared as %s (add `enter %s` before other statements)%s", name, name, suggest(name, entered))
+	}
+}
+
+func (l *linter) checkConverged(instr Instruction) {
+	names := instr.args
+	if len(names) > 0 && names[0] == "+keys" {
+		names = names[1:]
+	}
+	if len(names) == 1 && names[0] == "*" {
+		return
+	}
+	if len(names) < 2 {
+		l.problem(instr, "converged expects * or at least two names to compare, got %d", len(names))
+		return
+	}
+	for _, name := range names {
+		l.checkName(instr, name)
+	}
+}
+
+func (l *linter) checkLoad(instr Instruction) {
+	if l.fixtures == "" {
+		l.problem(instr, "no fixtures provided with --fixtures, yet tried to load feed from log.offset")
+		return
+	}
+	if len(instr.args) < 2 {
+		return
+	}
+	if _, ok := l.fixturesIds[instr.args[1]]; !ok {
+		l.problem(instr, "cannot find id %s in %s", instr.args[1], filepath.Join(l.fixtures, "secret-ids.json"))
+	}
+}
+
+// lint statically checks the parsed test of the simulator. declared are the puppets which exist before the test
+// starts, i.e. those of --from-snapshot
+func (s Simulator) lint(declared map[string]bool) []string {
+	l := linter{implementations: s.implementations, fixtures: s.fixtures, fixturesIds: s.fixturesIds, snapshotDir: s.snapshotDir, declared: declared}
+	return l.lint(s.instructions)
+}
+
+// Lint checks the test file of args for problems which would otherwise only be found once the simulation reaches
+// them, without starting any puppets. the implementations are only checked if any sbots are passed
+func Lint(args Args, sbots []string) []string {
+	if _, err := os.Stat(args.Testfile); err != nil {
+		return []string{fmt.Sprintf("test file %s not found", args.Testfile)}
+	}
+	lines, err := readTestFile(args.Testfile, nil)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	for _, line := range lines {
+		if strings.TrimSpace(line.text) == "" {
+			return []string{fmt.Sprintf("%s was empty; empty lines are not allowed", line.pos())}
+		}
+	}
+	// every implementation passed to netsim may take any role, so binding them all to the first is as good as any
+	var roles map[string]string
+	if len(sbots) > 0 {
+		roles = make(map[string]string)
+		impl := implementationNames(sbots[:1])[0]
+		for _, role := range findRoles(lines) {
+			roles[role] = impl
+		}
+	}
+	expanded, err := expandTest(lines, roles)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	l, problems := newLinter(args, sbots)
+	return append(problems, l.lint(makeInstructions(args.Testfile, expanded))...)
+}
+
+// newLinter returns a linter for the implementations & fixtures of args, along with any problems with them
+func newLinter(args Args, sbots []string) (linter, []string) {
+	var problems []string
+	l := linter{fixtures: args.FixturesDir, fixturesIds: make(map[string]FixturesFeedInfo), snapshotDir: snapshotDirPath(args.SnapshotDir)}
+	if len(sbots) > 0 {
+		l.implementations = make(map[string]string)
+		for _, bot := range sbots {
+			if _, err := os.Stat(filepath.Join(bot, "sim-shim.sh")); err != nil {
+				problems = append(problems, fmt.Sprintf("sim-shim.sh is missing from root of sbot folder %s", bot))
+			}
+			botDir, err := filepath.Abs(bot)
+			if err != nil {
+				return l, append(problems, err.Error())
+			}
+			l.implementations[filepath.Base(botDir)] = botDir
+		}
+	}
+	if args.FromSnapshot != "" {
+		manifest, err := readSnapshotManifest(l.snapshotDir, args.FromSnapshot)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		l.declared = manifest.names()
+	}
+	if args.FixturesDir != "" {
+		b, err := os.ReadFile(filepath.Join(args.FixturesDir, "secret-ids.json"))
+		if err == nil {
+			err = json.Unmarshal(b, &l.fixturesIds)
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("could not read secret-ids.json from --fixtures %s (%s)", args.FixturesDir, err))
+		}
+	}
+	return l, problems
+}
+
+func commandNames() []string {
+	var names []string
+	for name := range commandTable {
+		names = append(names, name)
+	}
+	return names
+}
+
+func mapKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// suggest returns a "did you mean" hint for the candidate closest to word, if any is close enough to be a likely typo
+func suggest(word string, candidates []string) string {
+	sort.Strings(candidates)
+	best, bestDistance := "", 3
+	for _, candidate := range candidates {
+		if d := editDistance(word, candidate); d < bestDistance {
+			best, bestDistance = candidate, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf("; did you mean %s?", best)
+}
+
+// editDistance is the levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func minInt(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
@@ -0,0 +1,41 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLint(t *testing.T) {
+	a := assert.New(t)
+
+	var cases = map[string][]string{
+		"enter alice\nstart alice go-sbot\npost alice":         nil,
+		"enter alice\nposst alice":                             {"line 2: unknown command posst; did you mean post?"},
+		"enter alice\nfrobnicate alice":                        {"line 2: unknown command frobnicate"},
+		"enter alice\nfollow alice":                            {"line 2: follow expects 2 arguments, got 1"},
+		"enter alice\npost alice bob":                          {"line 2: post expects 1 arguments, got 2"},
+		"enter alice\nfollow alice bob\nfollow alice bob":      {"line 2: there is no puppet declared as bob (add `enter bob` before other statements)"},
+		"enter alice\npost alicee":                             {"line 2: there is no puppet declared as alicee (add `enter alicee` before other statements); did you mean alice?"},
+		"post alice\nenter alice":                              {"line 1: there is no puppet declared as alice (add `enter alice` before other statements)"},
+		"parallel\nparallel\nend\nend":                         {"line 2: parallel blocks can't be nested (the block opened on line 1 is still open)", "line 4: end without a matching parallel"},
+		"enter alice\nparallel\npost alice":                    {"line 2: parallel block is missing its `end`"},
+		"enter alice\nstart alice go-sbt":                      {"line 2: implementation go-sbt was not passed to netsim; did you mean go-sbot?"},
+		"enter alice\nstart alice rust-sbot":                   {"line 2: implementation rust-sbot was not passed to netsim"},
+		"enter alice\nenter bob\nlatency alice bob fast":       {`line 3: latency "fast" was neither a duration (e.g. 200ms) nor a number of milliseconds`},
+		"enter alice\nenter bob\ndroprate alice bob 150%":      {`line 3: drop rate "150%" should be a percentage between 0% and 100%`},
+		"enter alice\nbandwidth alice 64kb":                    {`line 2: bandwidth "64kb" had an unknown unit "kb" (use bit, kbit, mbit, gbit, bps, kbps or mbps)`},
+		"enter alice\nenter bob\nlatency alice bob 50ms":       nil,
+		"enter alice\nenter bob\nconverged +keys alice":        {"line 3: converged expects * or at least two names to compare, got 1"},
+		"enter alice\nenter bob\nconverged +keys alice bob\n#": nil,
+		"enter alice\nparallel\npost alice\nsnapshot s1\nend":  {"line 4: snapshot stops & starts every puppet, and can't be part of the parallel block opened on line 2"},
+	}
+	for test, problems := range cases {
+		l := linter{implementations: map[string]string{"go-sbot": "", "ssb-server": ""}}
+		a.Equal(problems, l.lint(makeInstructions("", statements(test))), test)
+	}
+}
@@ -0,0 +1,256 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// implementation roles are variables named IMPL_<something>, which a test uses in place of an implementation folder,
+// e.g. `start alice $IMPL_A`. netsim binds them to the sbots it was passed, so that the same test can be run against
+// every combination of implementations with --matrix
+var rolePattern = regexp.MustCompile(`\$\{(IMPL_\w+)\}|\$(IMPL_\w+)`)
+
+// findRoles returns the implementation roles used by the test, sorted by name. variables named like a role which the
+// test defines itself with `set` are left alone
+func findRoles(lines []statement) []string {
+	used := make(map[string]bool)
+	defined := make(map[string]bool)
+	for _, line := range lines {
+		text := strings.TrimSpace(line.text)
+		if matches := setPattern.FindStringSubmatch(text); matches != nil {
+			defined[matches[1]] = true
+		}
+		for _, groups := range rolePattern.FindAllStringSubmatch(text, -1) {
+			used[groups[1]+groups[2]] = true
+		}
+	}
+	var roles []string
+	for role := range used {
+		if !defined[role] {
+			roles = append(roles, role)
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+// implementationNames returns the folder names of the sbots, in the order they were passed, which is how tests refer
+// to them
+func implementationNames(sbots []string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, bot := range sbots {
+		botDir, err := filepath.Abs(bot)
+		if err != nil {
+			bail(err.Error())
+		}
+		name := filepath.Base(botDir)
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// bindRoles assigns implementations to the roles of a test run without --matrix. with a single implementation, every
+// role uses it; otherwise the roles take the implementations in the order they were passed
+func bindRoles(roles, impls []string) (map[string]string, error) {
+	if len(roles) == 0 {
+		return nil, nil
+	}
+	if len(impls) > 1 && len(impls) < len(roles) {
+		return nil, fmt.Errorf("the test uses %d implementation roles (%s), but only %d sbots were passed; pass one sbot per role, or run every combination with --matrix",
+			len(roles), strings.Join(roles, ", "), len(impls))
+	}
+	binding := make(map[string]string)
+	for i, role := range roles {
+		if len(impls) == 1 {
+			binding[role] = impls[0]
+		} else {
+			binding[role] = impls[i]
+		}
+	}
+	return binding, nil
+}
+
+// roleAssignments returns every way of assigning the implementations to the roles, where an implementation may take
+// more than one role: roles A & B with implementations go & js make go-go, go-js, js-go and js-js
+func roleAssignments(roles, impls []string) []map[string]string {
+	assignments := []map[string]string{{}}
+	for _, role := range roles {
+		var next []map[string]string
+		for _, assignment := range assignments {
+			for _, impl := range impls {
+				binding := make(map[string]string, len(assignment)+1)
+				for k, v := range assignment {
+					binding[k] = v
+				}
+				binding[role] = impl
+				next = append(next, binding)
+			}
+		}
+		assignments = next
+	}
+	return assignments
+}
+
+// MatrixRun is the outcome of running the test with one assignment of implementations to its roles
+type MatrixRun struct {
+	Roles  map[string]string
+	Report *Report
+}
+
+// RunMatrix runs the test of args once for every assignment of the sbots to the implementation roles it uses. each run
+// gets a puppet directory of its own inside of args.Outdir, named after the implementations it assigned; the reports
+// and samples written by the runs are named likewise. a summary of the outcome of every run is printed at the end
+func RunMatrix(args Args, sbots []string) []MatrixRun {
+	args.Outdir = puppetDirPath(args.Outdir)
+	requireTAP(args, "--matrix")
+	lines := readTest(args.Testfile)
+	roles := findRoles(lines)
+	if len(roles) == 0 {
+		bail(fmt.Sprintf("%s doesn't use any implementation roles, such as `start alice $IMPL_A`, so there is no matrix to run", args.Testfile))
+	}
+	impls := implementationNames(sbots)
+	preparePuppetDir(args.Outdir)
+
+	assignments := roleAssignments(roles, impls)
+	var runs []MatrixRun
+	for i, binding := range assignments {
+		runArgs := startSubrun(args, cellName(roles, binding), os.Stdout)
+		taplog(fmt.Sprintf("matrix run %d of %d: %s", i+1, len(assignments), describeBinding(roles, binding)))
+		report := simulate(runArgs, sbots, lines, binding, nil)
+		runs = append(runs, MatrixRun{Roles: binding, Report: report})
+		if report.Interrupted {
+			break
+		}
+	}
+	logMatrix(roles, impls, runs)
+	return runs
+}
+
+// requireTAP bails if the results of the several runs made by option can't be printed in the output format of args,
+// as e.g. a JUnit XML document only has room for a single run
+func requireTAP(args Args, option string) {
+	if args.Format != "" && args.Format != FormatTAP {
+		bail(fmt.Sprintf("%s only supports --format %s", option, FormatTAP))
+	}
+}
+
+// startSubrun prepares one of several runs made by a single invocation of netsim, e.g. with --matrix, and starts its
+// TAP output on w. the run gets a puppet directory of its own inside of args.Outdir, and its report & samples files
+// get name as a suffix
+func startSubrun(args Args, name string, w io.Writer) Args {
+	runArgs := args
+	runArgs.Outdir = filepath.Join(args.Outdir, name)
+	if err := os.Mkdir(runArgs.Outdir, 0777); err != nil {
+		log.Fatalln(err)
+	}
+	if args.Report != "" {
+		runArgs.Report = cellPath(args.Report, name)
+	}
+	if args.Samples != "" {
+		runArgs.Samples = cellPath(args.Samples, name)
+	}
+	defaultReporter = newTAPReporter(w)
+	defaultReporter.Start()
+	return runArgs
+}
+
+// cellName names the run of a binding after its implementations, in the order of the roles
+func cellName(roles []string, binding map[string]string) string {
+	impls := make([]string, len(roles))
+	for i, role := range roles {
+		impls[i] = binding[role]
+	}
+	return strings.Join(impls, "+")
+}
+
+func describeBinding(roles []string, binding map[string]string) string {
+	pairs := make([]string, len(roles))
+	for i, role := range roles {
+		pairs[i] = fmt.Sprintf("%s=%s", role, binding[role])
+	}
+	return strings.Join(pairs, " ")
+}
+
+// cellPath inserts the name of one of several runs into path, before its extension: report.json => report-go+js.json
+func cellPath(path, cell string) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(path, ext), cell, ext)
+}
+
+// matrixOutcome summarizes a run for the matrix: ok, or how many of its statements failed
+func matrixOutcome(report *Report) string {
+	counts := report.Counts()
+	switch {
+	case report.Interrupted:
+		return "interrupted"
+	case counts[StatusBailOut] > 0:
+		return "bail out"
+	case report.Passed():
+		return "ok"
+	}
+	failed := counts[StatusNotOk] + counts[StatusNotRun]
+	return fmt.Sprintf("FAIL %d/%d", failed, len(report.Instructions))
+}
+
+// logMatrix prints the outcome of the matrix runs. tests with two roles get a grid, with the implementations of the
+// first role as rows and those of the second as columns; any other number of roles gets a line per run
+func logMatrix(roles, impls []string, runs []MatrixRun) {
+	outcomes := make(map[string]string)
+	passed := 0
+	for _, run := range runs {
+		outcomes[cellName(roles, run.Roles)] = matrixOutcome(run.Report)
+		if run.Report.Passed() {
+			passed++
+		}
+	}
+	outcome := func(cell string) string {
+		if o, ok := outcomes[cell]; ok {
+			return o
+		}
+		// the matrix was interrupted before getting to this run
+		return "-"
+	}
+
+	taplog("\nMatrix results")
+	if len(roles) == 2 {
+		width := len(roles[0]) + len(roles[1]) + 3
+		for _, impl := range impls {
+			if len(impl) > width {
+				width = len(impl)
+			}
+		}
+		cellFmt := fmt.Sprintf("%%-%ds", width+2)
+		header := fmt.Sprintf(cellFmt, fmt.Sprintf("%s \\ %s", roles[0], roles[1]))
+		for _, col := range impls {
+			header += fmt.Sprintf(cellFmt, col)
+		}
+		taplog(strings.TrimRight(header, " "))
+		for _, row := range impls {
+			line := fmt.Sprintf(cellFmt, row)
+			for _, col := range impls {
+				line += fmt.Sprintf(cellFmt, outcome(cellName(roles, map[string]string{roles[0]: row, roles[1]: col})))
+			}
+			taplog(strings.TrimRight(line, " "))
+		}
+	} else {
+		for _, binding := range roleAssignments(roles, impls) {
+			taplog(fmt.Sprintf("%-40s %s", describeBinding(roles, binding), outcome(cellName(roles, binding))))
+		}
+	}
+	total := len(roleAssignments(roles, impls))
+	taplog(fmt.Sprintf("%d of %d combinations passed", passed, total))
+}
@@ -0,0 +1,41 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoles(t *testing.T) {
+	a := assert.New(t)
+
+	test := `
+set IMPL_C ssb-server
+start alice $IMPL_A
+start bob ${IMPL_B}
+start carol $IMPL_C
+reset alice $IMPL_A
+`
+	roles := findRoles(statements(test))
+	a.Equal([]string{"IMPL_A", "IMPL_B"}, roles)
+
+	binding, err := bindRoles(roles, []string{"go-sbot"})
+	a.NoError(err)
+	a.Equal(map[string]string{"IMPL_A": "go-sbot", "IMPL_B": "go-sbot"}, binding)
+	binding, err = bindRoles(roles, []string{"go-sbot", "ssb-server"})
+	a.NoError(err)
+	a.Equal(map[string]string{"IMPL_A": "go-sbot", "IMPL_B": "ssb-server"}, binding)
+	_, err = bindRoles(append(roles, "IMPL_D"), []string{"go-sbot", "ssb-server"})
+	a.Error(err)
+
+	var cells []string
+	for _, assignment := range roleAssignments(roles, []string{"go", "js"}) {
+		cells = append(cells, cellName(roles, assignment))
+	}
+	a.Equal([]string{"go+go", "go+js", "js+go", "js+js"}, cells)
+	a.Equal("out/report-go+js.json", cellPath("out/report.json", "go+js"))
+}
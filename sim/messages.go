@@ -0,0 +1,230 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/ssb-ngi-pointer/netsim/internal/verify"
+	"go.cryptoscope.co/muxrpc/v2"
+)
+
+// streamHistory streams the messages of author, as stored by p, starting at sequence from, to fn. the messages are
+// passed on as they were received, in the {key, value, timestamp} format. a limit of 0 streams the whole feed.
+// returning errStopStream from fn ends the stream early
+func streamHistory(p *Puppet, author string, from, limit int, fn func(msg json.RawMessage) error) error {
+	type histOptions struct {
+		ID    string `json:"id"`
+		Seq   int    `json:"seq"`
+		Limit int    `json:"limit,omitempty"`
+		Keys  bool   `json:"keys"`
+	}
+	opts := histOptions{ID: author, Seq: from, Limit: limit, Keys: true}
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+	src, err := sourceRequest(ctx, p, muxrpc.Method{"createHistoryStream"}, opts)
+	if err != nil {
+		return err
+	}
+
+	for src.Next(ctx) {
+		b, err := src.Bytes()
+		if err != nil {
+			return fmt.Errorf("createHistoryStream failed to read a message: %w", err)
+		}
+		err = fn(append(json.RawMessage{}, b...))
+		if errors.Is(err, errStopStream) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := src.Err(); err != nil {
+		return fmt.Errorf("createHistoryStream failed: %w", err)
+	}
+	return nil
+}
+
+var errStopStream = errors.New("stop streaming")
+
+// readHistory returns up to limit messages of author, as stored by p, starting at sequence from
+func readHistory(p *Puppet, author string, from, limit int) ([]json.RawMessage, error) {
+	var messages []json.RawMessage
+	err := streamHistory(p, author, from, limit, func(msg json.RawMessage) error {
+		messages = append(messages, msg)
+		if len(messages) >= limit {
+			return errStopStream
+		}
+		return nil
+	})
+	return messages, err
+}
+
+// DoVerifyFeed checks the integrity of dst's feed, as stored by src: the hash chain, the signature and key of every
+// message, and that the sequence numbers are contiguous. the first divergence is reported along with the message as
+// stored by dst itself
+func DoVerifyFeed(src, dst *Puppet) (string, error) {
+	chain := verify.Chain{Author: dst.feedID}
+	var diverged verify.Divergence
+	var divergedRaw json.RawMessage // the first message that failed verification
+	err := streamHistory(src, dst.feedID, 1, 0, func(raw json.RawMessage) error {
+		msg, err := verify.Decode(raw)
+		if err == nil {
+			err = chain.Append(msg)
+		} else {
+			err = verify.Divergence{Sequence: chain.Verified() + 1, Reason: err.Error()}
+		}
+		if errors.As(err, &diverged) {
+			divergedRaw = raw
+			return errStopStream
+		}
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if divergedRaw == nil {
+		if chain.Verified() == 0 {
+			m := fmt.Sprintf("expected %s to have messages of %s; it had none", src.name, dst.name)
+			return "", TestError{err: errors.New("feed not stored by src"), message: m}
+		}
+		return fmt.Sprintf("verified %d messages of %s, as stored by %s", chain.Verified(), dst.name, src.name), nil
+	}
+
+	// fetch the diverging message as stored by the feed's own puppet, for comparison
+	original := "(unavailable)"
+	messages, err := readHistory(dst, dst.feedID, int(diverged.Sequence), 1)
+	if err != nil {
+		original = fmt.Sprintf("(could not be read: %s)", err)
+	} else if len(messages) > 0 {
+		original = indentJSON(messages[0])
+	}
+	m := fmt.Sprintf("%s's feed, as stored by %s, diverged at %s\nstored by %s (%s):\n%s\nstored by %s (%s):\n%s",
+		dst.name, src.name, diverged, src.name, src.implementation, indentJSON(divergedRaw), dst.name, dst.implementation, original)
+	return "", TestError{err: errors.New("feed verification failed"), message: m}
+}
+
+// indentJSON pretty-prints raw json without reordering it, falling back to the raw text if it's malformed
+func indentJSON(raw json.RawMessage) string {
+	var b bytes.Buffer
+	if json.Indent(&b, raw, "", "  ") != nil {
+		return string(raw)
+	}
+	return b.String()
+}
+
+// DoHasMessage checks that src holds message seqno of dst's feed, and that the message has the expected fields.
+// the fields are nested like the message itself, i.e. {"value": {"content": {"type": "post"}}}
+func DoHasMessage(src, dst *Puppet, seqno string, expected map[string]interface{}) (string, error) {
+	assertedSeqno, message, err := extractSeqno(dst, seqno)
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s@%d", dst.name, assertedSeqno)
+
+	messages, err := readHistory(src, dst.feedID, assertedSeqno, 1)
+	if err != nil {
+		return "", err
+	}
+	if len(messages) == 0 {
+		m := fmt.Sprintf("expected %s to have %s; it didn't", src.name, name)
+		return "", TestError{err: errors.New("message not stored by src"), message: m}
+	}
+
+	var actual map[string]interface{}
+	err = json.Unmarshal(messages[0], &actual)
+	if err != nil {
+		return "", fmt.Errorf("%s returned a malformed message for %s (%w)", src.name, name, err)
+	}
+	if seq, _ := lookupField(actual, "value.sequence"); seq != float64(assertedSeqno) {
+		m := fmt.Sprintf("expected %s, was %s at sequence %v", name, dst.name, seq)
+		return "", TestError{err: errors.New("createHistoryStream returned the wrong message"), message: m}
+	}
+
+	diff := diffFields(expected, actual)
+	if len(diff) > 0 {
+		m := fmt.Sprintf("%s, as stored by %s, didn't match:\n%s", name, src.name, strings.Join(diff, "\n"))
+		return "", TestError{err: errors.New("message fields didn't match"), message: m}
+	}
+	return message, nil
+}
+
+// diffFields compares every leaf field of expected against the field at the same path of actual, returning a line
+// per mismatch. fields of actual which aren't mentioned in expected are ignored
+func diffFields(expected, actual map[string]interface{}) []string {
+	var diff []string
+	for _, path := range leafPaths(expected, "") {
+		want, _ := lookupField(expected, path)
+		got, found := lookupField(actual, path)
+		switch {
+		case !found:
+			diff = append(diff, fmt.Sprintf("  %s: expected %s, was missing", path, formatField(want)))
+		case !reflect.DeepEqual(normalizeField(want), normalizeField(got)):
+			diff = append(diff, fmt.Sprintf("  %s: expected %s, was %s", path, formatField(want), formatField(got)))
+		}
+	}
+	return diff
+}
+
+// leafPaths returns the dotted paths of all the fields of m which aren't objects themselves, sorted
+func leafPaths(m map[string]interface{}, prefix string) []string {
+	var paths []string
+	for key, value := range m {
+		path := prefix + key
+		if nested, ok := value.(map[string]interface{}); ok && len(nested) > 0 {
+			paths = append(paths, leafPaths(nested, path+".")...)
+			continue
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// lookupField returns the field of m at the dotted path
+func lookupField(m map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = m
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = obj[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// normalizeField round-trips a field through json, so that fields built by the parser compare equal to decoded ones
+func normalizeField(field interface{}) interface{} {
+	b, err := json.Marshal(field)
+	if err != nil {
+		return field
+	}
+	var normalized interface{}
+	if json.Unmarshal(b, &normalized) != nil {
+		return field
+	}
+	return normalized
+}
+
+func formatField(field interface{}) string {
+	b, err := json.Marshal(field)
+	if err != nil {
+		return fmt.Sprintf("%v", field)
+	}
+	return string(b)
+}
@@ -0,0 +1,500 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/*
+ * netsim minimize shrinks a failing test to a small test which still fails on the same assertion, using delta
+ * debugging. the test is expanded into plain statements (loops, macros & includes are gone), and run once to find
+ * its first failing statement: the target. the statements after the target are dropped right away, as they can't
+ * have influenced it. then:
+ *
+ *   1. each puppet the target doesn't name is removed along with every statement that names it
+ *   2. ever smaller chunks of the remaining statements are removed (ddmin), until no single statement can be removed
+ *
+ * after each removal the variant is repaired, so that it stays a valid test: statements naming a puppet which is no
+ * longer entered, or which need a puppet that is no longer running, are dropped as well. variants that still don't
+ * lint are never run. a variant is kept if the target still fails in it with the same error, up to the numbers & ids
+ * in it, and the smallest variant found so far is written after every improvement, so that an interrupted
+ * minimization isn't lost.
+ */
+
+// minimizer keeps track of the smallest variant of a failing test found so far
+type minimizer struct {
+	args    Args
+	sbots   []string
+	linter  linter
+	stmts   []statement // the expanded statements of the test; variants are lists of indices into stmts
+	target  int         // the index of the failing statement
+	failure string      // the error of the target in the original test, see normalizeError
+	best    []int
+	output  string // where the smallest variant is written
+	ports   *int
+	tried   map[string]bool // the variants that have already been run
+	run     func(stmts []statement) *Report
+	runs    int
+	maxRuns int // 0 for no limit
+
+	// the snapshots restored by the test, by label, as read from the snapshot folder
+	manifests map[string]snapshotManifest
+
+	// set once the minimization has to end early, e.g. because it was interrupted
+	stopped error
+}
+
+// Minimize runs the failing test of args, and searches for the smallest test that still fails on the same statement,
+// which is written to output. at most maxRuns variants are run, or any number if maxRuns is 0
+func Minimize(args Args, sbots []string, output string, maxRuns int) error {
+	args.Outdir = puppetDirPath(args.Outdir)
+	// only the outcome of each variant matters; the files of the runs would just pile up
+	args.Format, args.Report, args.SampleInterval = FormatTAP, "", 0
+	lines, err := readTestFile(args.Testfile, nil)
+	if err != nil {
+		return err
+	}
+	roles, err := bindRoles(findRoles(lines), implementationNames(sbots))
+	if err != nil {
+		return err
+	}
+	expanded, err := expandTest(lines, roles)
+	if err != nil {
+		return err
+	}
+	l, problems := newLinter(args, sbots)
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+	if problems := l.lint(makeInstructions(args.Testfile, expanded)); len(problems) > 0 {
+		return fmt.Errorf("%s has problems; see `netsim lint`:\n%s", args.Testfile, strings.Join(problems, "\n"))
+	}
+	preparePuppetDir(args.Outdir)
+
+	m := &minimizer{args: args, sbots: sbots, linter: l, output: output, ports: new(int), tried: make(map[string]bool), maxRuns: maxRuns}
+	m.run = m.simulate
+	fmt.Printf("running %s (%d statements) to find its first failing statement\n", args.Testfile, len(expanded))
+	m.runs++
+	report := m.run(expanded)
+	if report.Interrupted {
+		return errors.New("interrupted")
+	}
+	target := -1
+	for i, instr := range report.Instructions {
+		if instr.Status == StatusBailOut {
+			return fmt.Errorf("%s: %s aborted the test (%s); only failing assertions can be minimized", expanded[i].pos(), instr.Statement, instr.Error)
+		}
+		if instr.Status == StatusNotOk {
+			target = i
+			m.failure = normalizeError(instr.Error)
+			fmt.Printf("target: %s: %s (%s)\n", expanded[i].pos(), instr.Statement, instr.Error)
+			break
+		}
+	}
+	if target == -1 {
+		return fmt.Errorf("%s didn't fail, so there is nothing to minimize", args.Testfile)
+	}
+	m.stmts, m.target = expanded, target
+	m.minimize()
+	if m.stopped != nil {
+		fmt.Printf("stopped early: %s\n", m.stopped)
+	}
+	if len(m.best) == len(expanded) {
+		return fmt.Errorf("could not remove any statements from %s without the target passing", args.Testfile)
+	}
+	fmt.Printf("wrote %d of %d statements to %s after %d runs\n", len(m.best), len(expanded), m.output, m.runs)
+	return nil
+}
+
+// minimize shrinks the test, starting out from all of its statements
+func (m *minimizer) minimize() {
+	m.best = nil
+	for i := range m.stmts {
+		m.best = append(m.best, i)
+	}
+	m.try(m.truncated(), "dropped the statements after the target")
+	m.removePuppets()
+	m.ddmin()
+}
+
+// truncated returns the statements up to the target, or up to the end of the parallel block the target is in
+func (m *minimizer) truncated() []int {
+	end := m.target
+	for i := m.target + 1; i < len(m.stmts); i++ {
+		command := m.instruction(i).command
+		if command == "parallel" {
+			break
+		}
+		if command == "end" {
+			end = i
+			break
+		}
+	}
+	return m.best[:end+1]
+}
+
+// removePuppets tries to remove each puppet the target doesn't name, along with every statement naming it
+func (m *minimizer) removePuppets() {
+	needed := make(map[string]bool)
+	for _, name := range puppetsOf(m.instruction(m.target)) {
+		needed[name] = true
+	}
+	var names []string
+	for _, i := range m.best {
+		instr := m.instruction(i)
+		if instr.command == "enter" && len(instr.args) > 0 && !needed[instr.args[0]] {
+			names = append(names, instr.args[0])
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if m.stopped != nil {
+			return
+		}
+		var variant []int
+		for _, i := range m.best {
+			if !contains(puppetsOf(m.instruction(i)), name) {
+				variant = append(variant, i)
+			}
+		}
+		m.try(variant, fmt.Sprintf("removed %s", name))
+	}
+}
+
+// ddmin removes chunks of statements, halving the size of the chunks whenever none of them can be removed
+func (m *minimizer) ddmin() {
+	n := 2
+	for m.stopped == nil {
+		removable := m.removable()
+		if len(removable) < 1 {
+			return
+		}
+		if n > len(removable) {
+			n = len(removable)
+		}
+		reduced := false
+		for i := 0; i < n && m.stopped == nil; i++ {
+			// the i-th of n chunks of the removable statements
+			chunk := make(map[int]bool)
+			for _, index := range removable[i*len(removable)/n : (i+1)*len(removable)/n] {
+				chunk[index] = true
+			}
+			var variant []int
+			for j, index := range m.best {
+				if !chunk[j] {
+					variant = append(variant, index)
+				}
+			}
+			change := fmt.Sprintf("removed %d statements", len(chunk))
+			if len(chunk) == 1 {
+				change = "removed a statement"
+			}
+			if m.try(variant, change) {
+				reduced = true
+				break
+			}
+		}
+		switch {
+		case reduced:
+			if n > 2 {
+				n--
+			}
+		case n == len(removable):
+			// no single statement can be removed
+			return
+		default:
+			n *= 2
+		}
+	}
+}
+
+// removable returns the positions of the statements in the best variant that may be removed; parallel blocks are
+// removed by repair, once they are empty
+func (m *minimizer) removable() []int {
+	var positions []int
+	for j, i := range m.best {
+		switch m.instruction(i).command {
+		case "parallel", "end":
+			continue
+		}
+		if i != m.target {
+			positions = append(positions, j)
+		}
+	}
+	return positions
+}
+
+func (m *minimizer) instruction(i int) Instruction {
+	return parseTestLine(m.stmts[i].text, 0)
+}
+
+func (m *minimizer) statements(variant []int) []statement {
+	stmts := make([]statement, len(variant))
+	for j, i := range variant {
+		stmts[j] = m.stmts[i]
+	}
+	return stmts
+}
+
+// try repairs the variant and runs it, keeping it as the best variant if it's smaller and the target still fails
+func (m *minimizer) try(variant []int, change string) bool {
+	variant, ok := m.repair(variant)
+	if !ok || len(variant) >= len(m.best) {
+		return false
+	}
+	stmts := m.statements(variant)
+	spec := render(stmts)
+	if m.tried[spec] {
+		return false
+	}
+	m.tried[spec] = true
+	instructions := makeInstructions("", stmts)
+	l := m.linter
+	if problems := l.lint(instructions); len(problems) > 0 {
+		return false
+	}
+	if m.maxRuns > 0 && m.runs >= m.maxRuns {
+		m.stopped = fmt.Errorf("reached the limit of %d runs", m.maxRuns)
+		return false
+	}
+
+	m.runs++
+	report := m.run(stmts)
+	if report.Interrupted {
+		m.stopped = errors.New("interrupted")
+		return false
+	}
+	var result InstructionReport
+	for j, i := range variant {
+		if i == m.target {
+			result = report.Instructions[j]
+		}
+	}
+	if result.Status != StatusNotOk {
+		fmt.Printf("run %d: %s, %d statements: the target passed\n", m.runs, change, len(variant))
+		return false
+	}
+	// a variant which fails in another way, e.g. because a removed statement leaves the sbot unable to answer, would
+	// lead the minimization astray
+	if normalizeError(result.Error) != m.failure {
+		fmt.Printf("run %d: %s, %d statements: the target failed differently (%s)\n", m.runs, change, len(variant), result.Error)
+		return false
+	}
+	fmt.Printf("run %d: %s, %d statements: the target still fails\n", m.runs, change, len(variant))
+	m.best = variant
+	m.write()
+	return true
+}
+
+// simulate runs stmts quietly, in a fresh puppet directory
+func (m *minimizer) simulate(stmts []statement) *Report {
+	dir := filepath.Join(m.args.Outdir, "variant")
+	if err := os.RemoveAll(dir); err != nil {
+		bail(err.Error())
+	}
+	runArgs := startSubrun(m.args, "variant", io.Discard)
+	return simulate(runArgs, m.sbots, stmts, nil, m.ports)
+}
+
+// write saves the best variant to the output file
+func (m *minimizer) write() {
+	header := fmt.Sprintf("# minimized from %s by netsim minimize; %s fails", filepath.Base(m.args.Testfile), m.stmts[m.target].text)
+	err := os.WriteFile(m.output, []byte(header+"\n"+render(m.statements(m.best))), 0644)
+	if err != nil {
+		m.stopped = fmt.Errorf("could not write %s (%w)", m.output, err)
+	}
+}
+
+var (
+	feedIDsPattern = regexp.MustCompile(`@[A-Za-z0-9+/]{43}=\.ed25519`)
+	msgKeysPattern = regexp.MustCompile(`%[A-Za-z0-9+/]{43}=\.sha256`)
+	numbersPattern = regexp.MustCompile(`\d+`)
+)
+
+// normalizeError replaces the feed ids, message keys and numbers in the error of a failing statement, which may vary
+// between runs that fail in the same way, e.g. "latest was 3" or the port of a refused connection
+func normalizeError(err string) string {
+	err = feedIDsPattern.ReplaceAllString(err, "<feed>")
+	err = msgKeysPattern.ReplaceAllString(err, "<msg>")
+	return numbersPattern.ReplaceAllString(err, "<n>")
+}
+
+func render(stmts []statement) string {
+	var b strings.Builder
+	for _, stmt := range stmts {
+		b.WriteString(stmt.text)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// repair drops the statements of variant that would be invalid, or that don't affect the outcome of the target:
+//   - comments and timers
+//   - statements naming a puppet that wasn't entered before them
+//   - statements which query a puppet's sbot, starts of running puppets and stops of stopped puppets
+//   - entered puppets which are never used, and empty parallel blocks
+//
+// the puppets of --from-snapshot count as entered from the start, and those of a restored snapshot from its restore on.
+// ok is false if the target itself would have to be dropped
+func (m *minimizer) repair(variant []int) ([]int, bool) {
+	entered := make(map[string]bool)
+	running := make(map[string]bool)
+	if m.args.FromSnapshot != "" {
+		m.restored(m.args.FromSnapshot, nil, entered, running)
+	}
+	taken := make(map[string]map[string]bool) // the puppets running at each snapshot taken by the variant
+	var kept []int
+	for _, i := range variant {
+		instr := m.instruction(i)
+		names := puppetsOf(instr)
+		keep := true
+		switch instr.command {
+		case "#", "comment", "timerstart", "timerstop":
+			keep = false
+		case "enter":
+			entered[instr.args[0]] = true
+		case "snapshot":
+			taken[instr.args[0]] = make(map[string]bool)
+			for name, up := range running {
+				taken[instr.args[0]][name] = up
+			}
+		case "restore":
+			m.restored(instr.args[0], taken, entered, running)
+		default:
+			for _, name := range names {
+				keep = keep && entered[name]
+			}
+		}
+		switch {
+		case !keep:
+		case instr.command == "start":
+			keep = !running[instr.args[0]]
+			running[instr.args[0]] = true
+		case instr.command == "stop":
+			keep = running[instr.args[0]]
+			running[instr.args[0]] = false
+		case needsSbot(instr.command):
+			for _, name := range names {
+				keep = keep && running[name]
+			}
+		}
+		if !keep && i == m.target {
+			return nil, false
+		}
+		if keep {
+			kept = append(kept, i)
+		}
+	}
+
+	used := make(map[string]bool)
+	for _, i := range kept {
+		instr := m.instruction(i)
+		if instr.command != "enter" {
+			for _, name := range puppetsOf(instr) {
+				used[name] = true
+			}
+		}
+	}
+	var repaired []int
+	for j, i := range kept {
+		instr := m.instruction(i)
+		switch {
+		case instr.command == "enter" && !used[instr.args[0]]:
+			continue
+		case instr.command == "parallel" && j+1 < len(kept) && m.instruction(kept[j+1]).command == "end":
+			continue
+		case instr.command == "end" && j > 0 && m.instruction(kept[j-1]).command == "parallel":
+			continue
+		}
+		repaired = append(repaired, i)
+	}
+	return repaired, true
+}
+
+// restored updates the entered & running puppets as restoring the snapshot named label does: its puppets are entered,
+// and only those that were running when it was taken are running afterwards. snapshots that weren't taken earlier in
+// the variant are read from the snapshot folder
+func (m *minimizer) restored(label string, taken map[string]map[string]bool, entered, running map[string]bool) {
+	for name := range running {
+		running[name] = false
+	}
+	if snapshot, ok := taken[label]; ok {
+		for name, up := range snapshot {
+			running[name] = up
+		}
+		return
+	}
+	if m.manifests == nil {
+		m.manifests = make(map[string]snapshotManifest)
+	}
+	manifest, ok := m.manifests[label]
+	if !ok {
+		// a missing snapshot leaves the variant without the puppets, and the linter rejects its restore
+		manifest, _ = readSnapshotManifest(snapshotDirPath(m.args.SnapshotDir), label)
+		m.manifests[label] = manifest
+	}
+	for _, snap := range manifest.Puppets {
+		entered[snap.Name] = true
+		running[snap.Name] = snap.Running
+	}
+}
+
+// needsSbot reports whether command talks to the sbots of the puppets it names, which then have to be running
+func needsSbot(command string) bool {
+	if _, ok := commandMethods[command]; ok {
+		return true
+	}
+	return command == "converged"
+}
+
+// puppetsOf returns the names of the puppets referred to by instr
+func puppetsOf(instr Instruction) []string {
+	var names []string
+	switch instr.command {
+	case "converged":
+		for _, arg := range instr.args {
+			if arg != "+keys" && arg != "*" {
+				names = append(names, arg)
+			}
+		}
+		return names
+	case "partition":
+		groups, _ := parsePartitionGroups(instr.line)
+		for _, group := range groups {
+			names = append(names, group...)
+		}
+		return names
+	}
+	spec := commandTable[instr.command]
+	for i, arg := range instr.args {
+		if i >= len(spec.args) {
+			break
+		}
+		switch spec.args[i] {
+		case argName:
+			names = append(names, arg)
+		case argSeqno:
+			names = append(names, strings.Split(arg, "@")[0])
+		}
+	}
+	return names
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMinimize(t *testing.T) {
+	a := assert.New(t)
+
+	test := `
+enter alice
+enter bob
+enter carol
+parallel
+start alice go-sbot
+start bob go-sbot
+start carol go-sbot
+end
+post bob
+follow alice bob
+block alice bob
+connect alice carol
+timerstart sync
+post carol
+# alice should have bob's post, but blocking bob breaks it
+has alice bob@1
+has alice carol@1
+stop alice
+`
+	stmts := statements(test)
+	output := filepath.Join(t.TempDir(), "test-min.txt")
+	m := &minimizer{stmts: stmts, target: 15, output: output, tried: make(map[string]bool)}
+	m.failure = normalizeError("alice did not have bob@1 (latest was 0)")
+	a.Equal("has alice bob@1", stmts[m.target].text)
+	// the target fails whenever alice blocks bob before it, and for another reason if alice doesn't follow bob
+	runs := 0
+	m.run = func(stmts []statement) *Report {
+		runs++
+		report := &Report{}
+		blocked, following := false, false
+		for _, stmt := range stmts {
+			result := InstructionReport{Statement: stmt.text, Status: StatusOk}
+			switch stmt.text {
+			case "block alice bob":
+				blocked = true
+			case "follow alice bob":
+				following = true
+			case "has alice bob@1":
+				if !following {
+					result.Status, result.Error = StatusNotOk, "alice isn't replicating bob"
+				} else if blocked {
+					// the numbers of the error vary between runs
+					result.Status, result.Error = StatusNotOk, fmt.Sprintf("alice did not have bob@1 (latest was %d)", runs%2)
+				}
+			}
+			report.Instructions = append(report.Instructions, result)
+		}
+		return report
+	}
+	m.minimize()
+
+	a.NoError(m.stopped)
+	var minimized []string
+	for _, stmt := range m.statements(m.best) {
+		minimized = append(minimized, stmt.text)
+	}
+	a.Equal([]string{
+		"enter alice",
+		"enter bob",
+		"parallel",
+		"start alice go-sbot",
+		"start bob go-sbot",
+		"end",
+		"follow alice bob",
+		"block alice bob",
+		"has alice bob@1",
+	}, minimized)
+	b, err := os.ReadFile(output)
+	a.NoError(err)
+	a.Contains(string(b), "follow alice bob\nblock alice bob\nhas alice bob@1\n")
+}
+
+func TestMinimizeSnapshot(t *testing.T) {
+	a := assert.New(t)
+
+	dir := t.TempDir()
+	manifest, err := json.Marshal(snapshotManifest{Label: "base", Puppets: []puppetSnapshot{
+		{Name: "alice", Running: true},
+		{Name: "bob", Running: true},
+		{Name: "carol"},
+	}})
+	a.NoError(err)
+	a.NoError(os.MkdirAll(filepath.Join(dir, "base"), 0700))
+	a.NoError(os.WriteFile(filepath.Join(dir, "base", snapshotManifestFile), manifest, 0644))
+
+	// the target fails whenever alice blocks bob before it
+	run := func(stmts []statement) *Report {
+		report := &Report{}
+		blocked := false
+		for _, stmt := range stmts {
+			result := InstructionReport{Statement: stmt.text, Status: StatusOk}
+			if stmt.text == "block alice bob" {
+				blocked = true
+			}
+			if stmt.text == "has alice bob@1" && blocked {
+				result.Status, result.Error = StatusNotOk, "alice did not have bob@1"
+			}
+			report.Instructions = append(report.Instructions, result)
+		}
+		return report
+	}
+	minimize := func(args Args, test string, target int) []string {
+		l := linter{snapshotDir: dir}
+		if args.FromSnapshot != "" {
+			l.declared = map[string]bool{"alice": true, "bob": true, "carol": true}
+		}
+		args.SnapshotDir = dir
+		m := &minimizer{args: args, linter: l, stmts: statements(test), target: target, output: filepath.Join(t.TempDir(), "test-min.txt"), tried: make(map[string]bool), run: run}
+		m.failure = normalizeError("alice did not have bob@1")
+		m.minimize()
+		a.NoError(m.stopped)
+		var minimized []string
+		for _, stmt := range m.statements(m.best) {
+			minimized = append(minimized, stmt.text)
+		}
+		return minimized
+	}
+
+	// the puppets of --from-snapshot are entered & running from the start
+	a.Equal([]string{"block alice bob", "has alice bob@1"},
+		minimize(Args{FromSnapshot: "base"}, "post bob\npost carol\nblock alice bob\npost alice\nhas alice bob@1", 4))
+
+	// and those of a restored snapshot from its restore on
+	a.Equal([]string{"restore base", "block alice bob", "has alice bob@1"},
+		minimize(Args{}, "enter dan\nrestore base\npost bob\nblock alice bob\nhas alice bob@1", 4))
+
+	// only the puppets that were running when the snapshot was taken are running after its restore
+	repaired := func(test string) []string {
+		m := &minimizer{args: Args{SnapshotDir: dir}, stmts: statements(test), target: -1}
+		var variant []int
+		for i := range m.stmts {
+			variant = append(variant, i)
+		}
+		kept, ok := m.repair(variant)
+		a.True(ok)
+		var texts []string
+		for _, stmt := range m.statements(kept) {
+			texts = append(texts, stmt.text)
+		}
+		return texts
+	}
+	a.Equal([]string{"restore base", "block alice bob"}, repaired("restore base\nblock carol bob\nblock alice bob"))
+	a.Equal([]string{"enter alice", "snapshot s", "start alice go-sbot", "restore s", "start alice go-sbot", "post alice"},
+		repaired("enter alice\nsnapshot s\nstart alice go-sbot\nrestore s\npost alice\nstart alice go-sbot\npost alice"))
+}
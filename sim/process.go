@@ -0,0 +1,175 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the number of lines of a puppet's log included when it crashes
+const crashLogTail = 20
+
+// Process is a running sim-shim.sh, along with the sbot it started. the shim is started in a process group of its
+// own, so that the whole group can be stopped without leaving the sbot behind
+type Process struct {
+	cmd     *exec.Cmd
+	logfile *os.File
+	pidfile string        // records the process group, so that it can be cleaned up if netsim dies without stopping it
+	done    chan struct{} // closed once the shim has exited
+
+	mu       sync.Mutex
+	stopping bool   // set once netsim stops the process; any other exit is a crash
+	state    string // how the shim exited, e.g. "exit status 1"
+}
+
+// startProcess starts cmd in a new process group, recording the group in pidfile. problems that don't stop the process
+// from running are passed to note
+func startProcess(cmd *exec.Cmd, logfile *os.File, pidfile string, note func(string)) (*Process, error) {
+	setProcessGroup(cmd)
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	proc := &Process{cmd: cmd, logfile: logfile, pidfile: pidfile, done: make(chan struct{})}
+	err = os.WriteFile(pidfile, []byte(strconv.Itoa(cmd.Process.Pid)), 0644)
+	if err != nil {
+		note(fmt.Sprintf("could not write %s (%s); the puppet won't be cleaned up if netsim is killed", pidfile, err))
+	}
+	return proc, nil
+}
+
+// watch waits for the shim to exit. if it wasn't stopped by netsim, onCrash is called with how it exited, after the
+// rest of its process group has been killed to free up its ports
+func (proc *Process) watch(onCrash func(state string)) {
+	_ = proc.cmd.Wait()
+	proc.logfile.Close()
+
+	proc.mu.Lock()
+	proc.state = proc.cmd.ProcessState.String()
+	crashed := !proc.stopping
+	proc.mu.Unlock()
+	close(proc.done)
+
+	if crashed {
+		_ = killGroup(proc.cmd.Process.Pid)
+		os.Remove(proc.pidfile)
+		onCrash(proc.state)
+	}
+}
+
+// exited reports whether the shim has exited
+func (proc *Process) exited() bool {
+	select {
+	case <-proc.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (proc *Process) exitState() string {
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+	return proc.state
+}
+
+func (proc *Process) markStopping() {
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+	proc.stopping = true
+}
+
+// stop interrupts the process group, giving it grace to shut down cleanly before it is killed
+func (proc *Process) stop(grace time.Duration) error {
+	proc.markStopping()
+	// once the shim has exited, its pid may be reused by an unrelated process
+	if proc.exited() {
+		return nil
+	}
+	pid := proc.cmd.Process.Pid
+	err := interruptGroup(pid)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(grace)
+	for groupAlive(pid) && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	// kill whatever is left, including any processes the shim left behind when it exited
+	err = killGroup(pid)
+	<-proc.done
+	os.Remove(proc.pidfile)
+	return err
+}
+
+// kill kills the process group right away, e.g. when the simulation is aborted
+func (proc *Process) kill() {
+	proc.markStopping()
+	if proc.exited() {
+		return
+	}
+	_ = killGroup(proc.cmd.Process.Pid)
+	os.Remove(proc.pidfile)
+}
+
+// killOrphans kills the puppets left running in dir by a previous run of netsim, e.g. because netsim itself was killed
+// before it could stop them, using the process groups recorded by startProcess. the puppets of a --matrix run are
+// found one level down, in the directory of each run
+func killOrphans(dir string) {
+	pidfiles, _ := filepath.Glob(filepath.Join(dir, "*.pid"))
+	nested, _ := filepath.Glob(filepath.Join(dir, "*", "*.pid"))
+	pidfiles = append(pidfiles, nested...)
+	for _, pidfile := range pidfiles {
+		b, err := os.ReadFile(pidfile)
+		if err != nil {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil || !groupAlive(pid) {
+			continue
+		}
+		name := strings.TrimSuffix(filepath.Base(pidfile), ".pid")
+		// the pidfile may be stale, e.g. after a reboot, and the group's id reused by a process that has nothing to
+		// do with netsim. puppets are started with their directory, next to the pidfile, as an argument
+		owned, err := puppetGroup(pid, filepath.Dir(pidfile))
+		if err != nil {
+			taplog(fmt.Sprintf("could not check whether process group %d of %s's stale pidfile is still the puppet, leaving it running: %s", pid, name, err))
+			continue
+		}
+		if !owned {
+			taplog(fmt.Sprintf("ignoring %s's stale pidfile: process group %d is no longer one of its puppets", name, pid))
+			continue
+		}
+		err = killGroup(pid)
+		if err != nil {
+			taplog(fmt.Sprintf("could not kill %s, left running by a previous run of netsim (process group %d): %s", name, pid, err))
+			continue
+		}
+		taplog(fmt.Sprintf("killed %s, left running by a previous run of netsim (process group %d)", name, pid))
+	}
+}
+
+// puppetGroup reports whether any process of the group led by pid was started with an argument inside of dir, as the
+// shims of the puppets in dir are
+func puppetGroup(pid int, dir string) (bool, error) {
+	commands, err := groupCommands(pid)
+	if err != nil {
+		return false, err
+	}
+	prefix := filepath.Clean(dir) + string(filepath.Separator)
+	for _, command := range commands {
+		if strings.Contains(command, prefix) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,63 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+//go:build !windows
+// +build !windows
+
+package sim
+
+import (
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// setProcessGroup makes cmd the leader of a new process group, which the processes it starts inherit
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalGroup sends sig to every process of the group led by pid. a group which no longer exists is not an error
+func signalGroup(pid int, sig syscall.Signal) error {
+	err := syscall.Kill(-pid, sig)
+	if errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+	return err
+}
+
+// interruptGroup asks the processes of the group to shut down, which lets sbots clean up after themselves
+func interruptGroup(pid int) error {
+	return signalGroup(pid, syscall.SIGINT)
+}
+
+func killGroup(pid int) error {
+	return signalGroup(pid, syscall.SIGKILL)
+}
+
+// groupAlive reports whether any process of the group led by pid is still running
+func groupAlive(pid int) bool {
+	return syscall.Kill(-pid, 0) == nil
+}
+
+// groupCommands returns the command lines of the processes in the group led by pid
+func groupCommands(pid int) ([]string, error) {
+	out, err := exec.Command("ps", "-A", "-ww", "-o", "pgid=", "-o", "args=").Output()
+	if err != nil {
+		return nil, err
+	}
+	var commands []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		if pgid, err := strconv.Atoi(fields[0]); err == nil && pgid == pid {
+			commands = append(commands, strings.Join(fields[1:], " "))
+		}
+	}
+	return commands, nil
+}
@@ -0,0 +1,60 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+//go:build windows
+// +build windows
+
+package sim
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// setProcessGroup starts cmd in a new process group, so that it doesn't receive the console's ctrl-c meant for netsim
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// interruptGroup kills the process tree right away, as windows doesn't support interrupting processes
+func interruptGroup(pid int) error {
+	return killGroup(pid)
+}
+
+// killGroup kills the process tree rooted at pid. windows has no way of finding the processes of a tree once its
+// root has exited, so any processes it left behind are out of reach
+func killGroup(pid int) error {
+	if !groupAlive(pid) {
+		return nil
+	}
+	return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(pid)).Run()
+}
+
+// groupAlive reports whether the root of the process tree is still running
+func groupAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
+// groupCommands returns the command line of the root of the process tree, the only process of it windows can find
+func groupCommands(pid int) ([]string, error) {
+	query := fmt.Sprintf("(Get-CimInstance Win32_Process -Filter 'ProcessId=%d').CommandLine", pid)
+	out, err := exec.Command("powershell", "-NoProfile", "-Command", query).Output()
+	if err != nil {
+		return nil, err
+	}
+	command := strings.TrimSpace(string(out))
+	if command == "" {
+		return nil, nil
+	}
+	return []string{command}, nil
+}
@@ -10,28 +10,58 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"runtime"
 	"strconv"
+	"sync"
 	"time"
 )
 
 type Puppet struct {
-	directory     string
-	feedID        string
-	name          string
-	caps          string
-	secretDir     string
-	omitOffset    bool
-	allOffsets    bool
-	port          int
-	hops          int
-	seqno         int
-	totalMessages int
-	totalFeeds    int
-	totalTime     time.Duration
-	slept         time.Duration
-	lastStart     time.Time
-	process       Process // holds cmd & logfile of a running puppet process
+	directory      string
+	implementation string // the implementation folder the puppet was last started with
+	feedID         string
+	name           string
+	caps           string
+	secretDir      string
+	identitySeed   string // the puppet's identity is derived from it, see seededKeyPair; empty if its sbot creates one
+	secret         string // path of the secret of the seeded identity, as passed to the shim; empty if it has none
+	omitOffset     bool
+	allOffsets     bool
+	port           int
+	hops           int
+	seqno          int
+	totalMessages  int
+	totalFeeds     int
+	totalTime      time.Duration
+	slept          time.Duration
+	lastStart      time.Time
+	process        *Process // holds cmd & logfile of a running puppet process; nil once it has been stopped
+	rpc            *rpcConn // long-lived muxrpc session shared by all commands issued against the puppet
+	relay          *relay   // proxies all connections other puppets make to this puppet's sbot
+	resources      *resourceMonitor
+	notes          *puppetNotes
+}
+
+// puppetNotes holds the comments raised about a puppet outside of the instruction's own reporting, e.g. by its muxrpc
+// session or by its sbot exiting. they're reported by the next instruction to finish, which keeps them in line with its
+// output when it runs within a parallel block
+type puppetNotes struct {
+	mu      sync.Mutex
+	pending []string
+}
+
+func (n *puppetNotes) add(str string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.pending = append(n.pending, str)
+}
+
+// drain returns the notes raised since it was last called
+func (n *puppetNotes) drain() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	notes := n.pending
+	n.pending = nil
+	return notes
 }
 
 func (p Puppet) String() string {
@@ -73,7 +103,7 @@ func (p *Puppet) start(s Simulator, shim string) error {
 	var writer io.Writer
 	writer = logfile
 	if s.verbose {
-		writer = io.MultiWriter(os.Stdout, logfile)
+		writer = io.MultiWriter(echoWriter(), logfile)
 	}
 	if err != nil {
 		return TestError{err: err, message: "could not create log file"}
@@ -84,7 +114,7 @@ func (p *Puppet) start(s Simulator, shim string) error {
 	// sim-shim.sh contains logic for starting the corresponding sbot correctly.
 	// e.g. reading the passed in ssb directory ($1) and port ($2)
 	shimPath := filepath.Join(s.implementations[shim], "sim-shim.sh")
-	cmd = exec.CommandContext(s.rootCtx, shimPath, p.directory, strconv.Itoa(p.port))
+	cmd = exec.Command(shimPath, p.directory, strconv.Itoa(p.port))
 
 	// the environment variables CAPS and HOPS contains the caps (default: ssb caps) and hops (default: 2) settings for
 	// the puppet, and must be set correctly in each implementation's sim-shim.sh
@@ -105,53 +135,57 @@ func (p *Puppet) start(s Simulator, shim string) error {
 			}
 			cmd.Env = append(cmd.Env, fmt.Sprintf("LOG_OFFSET=%s", offsetLoc))
 		}
+	} else if p.secret != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("SECRET=%s", p.secret))
 	}
 
 	cmd.Stderr = writer
 	cmd.Stdout = writer
 	// store cmd & logfile in puppet for use when we shut it down with e.g. the stop command
-	p.process = Process{cmd: cmd, logfile: logfile}
-	err = cmd.Start()
+	proc, err := startProcess(cmd, logfile, filepath.Join(s.puppetDir, fmt.Sprintf("%s.pid", p.name)), p.notes.add)
 	if err != nil {
+		logfile.Close()
 		return TestError{err: err, message: fmt.Sprintf("failure when creating puppet, see %s for information", filename)}
 	}
+	p.process = proc
+	p.rpc.open(p)
+	go p.resources.watch(proc, p.directory)
+	name, notes, rpc := p.name, p.notes, p.rpc
+	go proc.watch(func(state string) {
+		// nothing is listening at the crashed sbot's port anymore
+		rpc.close()
+		msg := fmt.Sprintf("%s exited unexpectedly (%s)", name, state)
+		if tail, err := tailFile(filename, crashLogTail); err == nil && tail != "" {
+			msg += fmt.Sprintf("\n--- last lines of %s.txt ---\n%s", name, tail)
+		}
+		notes.add(msg)
+	})
 
 	return nil
 }
 
-func (p *Puppet) stop() error {
+func (p *Puppet) stop(instr Instruction) error {
+	// a puppet that crashed has already been reported, and its process group killed
+	if p.crashed() {
+		instr.taplog(fmt.Sprintf("%s had already exited (%s)", p.name, p.process.exitState()))
+		p.rpc.close()
+		p.process = nil
+		return nil
+	}
 	// update the total message count before we stop this puppet
 	err := p.countMessages()
 	if err != nil {
-		taplog(fmt.Sprintf("%s had an error when trying to count db messages (%s)", p.name, err))
+		instr.taplog(fmt.Sprintf("%s had an error when trying to count db messages (%s)", p.name, err))
 	}
-	cmd, logfile := p.process.cmd, p.process.logfile
-	taplog(fmt.Sprintf("stopping %s (%s)", p.name, p.feedID))
-	// issue an interrupt to the process (allows us to do cleanup in sbots)
-	// Windows doesn't support Interrupt
-	if runtime.GOOS == "windows" {
-		cmd.Process.Signal(os.Kill)
-	} else {
-		cmd.Process.Signal(os.Interrupt)
-	}
-
-	// last resort shutdown
-	go func() {
-		time.Sleep(2 * time.Second)
-		_ = cmd.Process.Signal(os.Kill)
-	}()
-
-	// wait for the process to wrap up
-	err = cmd.Wait()
+	// tear down our muxrpc session before the sbot goes away
+	p.rpc.close()
+	instr.taplog(fmt.Sprintf("stopping %s (%s)", p.name, p.feedID))
+	// interrupt the whole process group (allows us to do cleanup in sbots), killing it if it takes too long
+	err = p.process.stop(2 * time.Second)
+	p.process = nil
 	if err != nil {
 		return TestError{err: err, message: fmt.Sprintf("failure when stopping puppet")}
 	}
-	// close the logfile
-	err = logfile.Close()
-	if err != nil {
-		return TestError{err: err, message: fmt.Sprintf("failure when closing logfile")}
-	}
-	p.process = Process{}
 	return nil
 }
 
@@ -160,7 +194,12 @@ func (p Puppet) usesFixtures() bool {
 }
 
 func (p Puppet) isExecuting() bool {
-	return p.process != Process{}
+	return p.process != nil && !p.process.exited()
+}
+
+// crashed reports whether the puppet's sbot exited without being stopped
+func (p Puppet) crashed() bool {
+	return p.process != nil && p.process.exited()
 }
 
 func (p *Puppet) bumpSeqno() {
@@ -0,0 +1,469 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+* puppets never talk to each other directly. every puppet gets a relay in front of its sbot listener, and whenever a
+* puppet is asked to connect to another, it is handed the address of a relay link dedicated to that (src, dst) pair.
+* the links are plain userspace tcp proxies that forward the (encrypted) byte stream between the two sbots, which lets
+* the netsim degrade the link in a controlled way:
+*   latency   a delay added to every chunk of data, in each direction
+*   droprate  the chance a chunk is "lost". as we are proxying tcp streams we can't drop data outright; instead we
+*             emulate what tcp does on loss, and hold the chunk (and everything behind it) for a retransmission timeout
+*   bandwidth a cap on the bits per second a puppet can send and receive, across all of its links
+*   partition groups of puppets that can't reach each other; active sessions are severed and new ones are refused
+ */
+
+// the minimum retransmission timeout used to emulate a lost chunk, as recommended by RFC 6298 (rounded down)
+const minRetransmissionTimeout = 200 * time.Millisecond
+
+// pair is an unordered pair of puppet names, used to key the conditions that apply to both directions of a link
+type pair struct {
+	a, b string
+}
+
+func makePair(a, b string) pair {
+	if a > b {
+		a, b = b, a
+	}
+	return pair{a: a, b: b}
+}
+
+// network keeps track of all relays, and the conditions that are currently being simulated between puppets
+type network struct {
+	mu         sync.Mutex
+	latency    map[pair]time.Duration
+	droprate   map[pair]float64
+	bandwidth  map[string]int64 // bits per second, 0 => unlimited
+	partitions map[string]int   // puppet name => partition group. puppets without a group can reach everyone
+	limiters   map[string]*rateLimiter
+	relays     []*relay
+	traffic    []*trafficSession // every session that has gone through any of the relays, in order of creation
+}
+
+func newNetwork() *network {
+	return &network{
+		latency:    make(map[pair]time.Duration),
+		droprate:   make(map[pair]float64),
+		bandwidth:  make(map[string]int64),
+		partitions: make(map[string]int),
+		limiters:   make(map[string]*rateLimiter),
+	}
+}
+
+func (n *network) setLatency(a, b string, d time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.latency[makePair(a, b)] = d
+}
+
+func (n *network) setDroprate(a, b string, rate float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.droprate[makePair(a, b)] = rate
+}
+
+func (n *network) setBandwidth(name string, bitsPerSecond int64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.bandwidth[name] = bitsPerSecond
+}
+
+// partition splits the passed in groups of puppets from each other, and severs any sessions crossing the groups
+func (n *network) partition(groups [][]string) {
+	n.mu.Lock()
+	n.partitions = make(map[string]int)
+	for i, group := range groups {
+		for _, name := range group {
+			n.partitions[name] = i + 1
+		}
+	}
+	relays := n.relays
+	n.mu.Unlock()
+
+	for _, r := range relays {
+		r.severPartitioned()
+	}
+}
+
+// heal removes all partitions
+func (n *network) heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.partitions = make(map[string]int)
+}
+
+func (n *network) isPartitioned(a, b string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	groupA, okA := n.partitions[a]
+	groupB, okB := n.partitions[b]
+	return okA && okB && groupA != groupB
+}
+
+// delay returns how long a chunk of data sent between a and b should be held back before it is delivered
+func (n *network) delay(a, b string) time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	key := makePair(a, b)
+	d := n.latency[key]
+	if rate := n.droprate[key]; rate > 0 && rand.Float64() < rate {
+		// the chunk was lost: wait out a retransmission timeout, which is at least a round trip
+		rto := 2 * d
+		if rto < minRetransmissionTimeout {
+			rto = minRetransmissionTimeout
+		}
+		d += rto
+	}
+	return d
+}
+
+// throttle blocks until the bandwidth caps of both the sending and the receiving puppet allow for size bytes to pass
+func (n *network) throttle(from, to string, size int) {
+	n.mu.Lock()
+	up, upLimiter := n.bandwidth[from], n.limiter(from+"/up")
+	down, downLimiter := n.bandwidth[to], n.limiter(to+"/down")
+	n.mu.Unlock()
+	upLimiter.wait(size, up)
+	downLimiter.wait(size, down)
+}
+
+// limiter must be called while holding n.mu
+func (n *network) limiter(key string) *rateLimiter {
+	l, ok := n.limiters[key]
+	if !ok {
+		l = &rateLimiter{}
+		n.limiters[key] = l
+	}
+	return l
+}
+
+// relayFor creates the relay which will sit in front of p's sbot listener
+func (n *network) relayFor(p *Puppet) *relay {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	r := &relay{network: n, dst: p, links: make(map[string]*link)}
+	n.relays = append(n.relays, r)
+	return r
+}
+
+// close shuts down all relays, and any sessions passing through them
+func (n *network) close() {
+	n.mu.Lock()
+	relays := n.relays
+	n.mu.Unlock()
+	for _, r := range relays {
+		r.close()
+	}
+}
+
+// rateLimiter paces writes so that they don't exceed a given bitrate
+type rateLimiter struct {
+	mu   sync.Mutex
+	next time.Time
+}
+
+func (l *rateLimiter) wait(size int, bitsPerSecond int64) {
+	if bitsPerSecond <= 0 {
+		return
+	}
+	transmission := time.Duration(float64(size*8) / float64(bitsPerSecond) * float64(time.Second))
+	l.mu.Lock()
+	start := time.Now()
+	if l.next.After(start) {
+		start = l.next
+	}
+	l.next = start.Add(transmission)
+	until := l.next
+	l.mu.Unlock()
+	time.Sleep(time.Until(until))
+}
+
+// relay sits in front of a puppet's sbot listener, with one link per puppet that has been asked to connect to it
+type relay struct {
+	network *network
+	dst     *Puppet
+	mu      sync.Mutex
+	links   map[string]*link // indexed by the name of the dialing puppet
+}
+
+// portFor returns the port src should dial to reach the relay's puppet, opening a new link if necessary
+func (r *relay) portFor(src *Puppet) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if l, ok := r.links[src.name]; ok {
+		return l.port, nil
+	}
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return -1, fmt.Errorf("could not open relay link %s->%s (%w)", src.name, r.dst.name, err)
+	}
+	l := &link{
+		src:      src.name,
+		relay:    r,
+		listener: listener,
+		port:     listener.Addr().(*net.TCPAddr).Port,
+		sessions: make(map[*session]bool),
+	}
+	r.links[src.name] = l
+	go l.serve()
+	return l.port, nil
+}
+
+// existingPort returns the port of src's link to the relay, without opening one if src never connected through it
+func (r *relay) existingPort(src *Puppet) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l, ok := r.links[src.name]
+	if !ok {
+		return -1, false
+	}
+	return l.port, true
+}
+
+func (r *relay) severPartitioned() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, l := range r.links {
+		if r.network.isPartitioned(l.src, r.dst.name) {
+			l.closeSessions()
+		}
+	}
+}
+
+func (r *relay) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, l := range r.links {
+		l.listener.Close()
+		l.closeSessions()
+	}
+}
+
+// link forwards connections from one specific puppet (src) to the relay's puppet
+type link struct {
+	src      string
+	relay    *relay
+	listener net.Listener
+	port     int
+	mu       sync.Mutex
+	sessions map[*session]bool
+}
+
+// session is a single proxied tcp connection going through a link
+type session struct {
+	in, out net.Conn
+	once    sync.Once
+	traffic *trafficSession
+}
+
+func (s *session) close() {
+	s.once.Do(func() {
+		s.in.Close()
+		s.out.Close()
+	})
+}
+
+type chunk struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+func (l *link) serve() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			// the listener was closed
+			return
+		}
+		go l.handle(conn)
+	}
+}
+
+func (l *link) handle(in net.Conn) {
+	dst := l.relay.dst
+	n := l.relay.network
+	if n.isPartitioned(l.src, dst.name) {
+		in.Close()
+		return
+	}
+	out, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", dst.port))
+	if err != nil {
+		in.Close()
+		return
+	}
+	sess := &session{in: in, out: out, traffic: n.recordSession(l.src, dst.name)}
+	l.mu.Lock()
+	l.sessions[sess] = true
+	l.mu.Unlock()
+
+	// tear down the whole session as soon as one of the directions is done
+	done := make(chan struct{}, 2)
+	go func() { l.pipe(out, in, l.src, dst.name, &sess.traffic.sent); done <- struct{}{} }()
+	go func() { l.pipe(in, out, dst.name, l.src, &sess.traffic.received); done <- struct{}{} }()
+	<-done
+	sess.close()
+	<-done
+	sess.traffic.end()
+
+	l.mu.Lock()
+	delete(l.sessions, sess)
+	l.mu.Unlock()
+}
+
+// pipe copies everything read from r to w, subjecting the data to the network conditions between from and to, and
+// accounting for what was delivered in counter
+func (l *link) pipe(w, r net.Conn, from, to string, counter *trafficCounter) {
+	n := l.relay.network
+	chunks := make(chan chunk, 64)
+	go func() {
+		defer close(chunks)
+		var last time.Time
+		for {
+			buf := make([]byte, 32*1024)
+			size, err := r.Read(buf)
+			if size > 0 {
+				deliverAt := time.Now().Add(n.delay(from, to))
+				// a delayed chunk delays everything behind it; tcp delivers in order
+				if deliverAt.Before(last) {
+					deliverAt = last
+				}
+				last = deliverAt
+				chunks <- chunk{data: buf[:size], deliverAt: deliverAt}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for c := range chunks {
+		time.Sleep(time.Until(c.deliverAt))
+		n.throttle(from, to, len(c.data))
+		written, err := w.Write(c.data)
+		counter.add(written)
+		if err != nil {
+			break
+		}
+	}
+	// unblock the reading goroutine, if it is still around, and drain whatever it had in flight
+	r.Close()
+	for range chunks {
+	}
+}
+
+func (l *link) closeSessions() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for sess := range l.sessions {
+		sess.close()
+	}
+}
+
+// parseLatency accepts a go duration (200ms, 1.5s) or a plain number of milliseconds
+func parseLatency(arg string) (time.Duration, error) {
+	if ms, err := strconv.Atoi(arg); err == nil {
+		if ms < 0 {
+			return 0, fmt.Errorf("latency %q was negative", arg)
+		}
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	d, err := time.ParseDuration(arg)
+	if err != nil {
+		return 0, fmt.Errorf("latency %q was neither a duration (e.g. 200ms) nor a number of milliseconds", arg)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("latency %q was negative", arg)
+	}
+	return d, nil
+}
+
+// parseDroprate accepts a percentage (5%) or a fraction (0.05)
+func parseDroprate(arg string) (float64, error) {
+	var rate float64
+	var err error
+	if strings.HasSuffix(arg, "%") {
+		rate, err = strconv.ParseFloat(strings.TrimSuffix(arg, "%"), 64)
+		rate = rate / 100
+	} else {
+		rate, err = strconv.ParseFloat(arg, 64)
+	}
+	if err != nil || rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("drop rate %q should be a percentage between 0%% and 100%%", arg)
+	}
+	return rate, nil
+}
+
+// the units use the same notation as tc(8): bit, kbit, mbit & gbit are bits per second, bps, kbps & mbps are bytes
+var bandwidthUnits = map[string]int64{
+	"bit":  1,
+	"kbit": 1000,
+	"mbit": 1000 * 1000,
+	"gbit": 1000 * 1000 * 1000,
+	"bps":  8,
+	"kbps": 8 * 1000,
+	"mbps": 8 * 1000 * 1000,
+}
+
+var bandwidthPattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)([a-z]+)$`)
+
+// parseBandwidth parses a bitrate such as 64kbit into bits per second. unlimited (or 0) removes the cap
+func parseBandwidth(arg string) (int64, error) {
+	arg = strings.ToLower(arg)
+	if arg == "unlimited" || arg == "0" {
+		return 0, nil
+	}
+	match := bandwidthPattern.FindStringSubmatch(arg)
+	if match == nil {
+		return 0, fmt.Errorf("bandwidth %q should be a number followed by a unit, e.g. 64kbit", arg)
+	}
+	unit, ok := bandwidthUnits[match[2]]
+	if !ok {
+		return 0, fmt.Errorf("bandwidth %q had an unknown unit %q (use bit, kbit, mbit, gbit, bps, kbps or mbps)", arg, match[2])
+	}
+	amount, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(amount * float64(unit)), nil
+}
+
+var partitionGroupPattern = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// parsePartitionGroups parses the groups of `partition {alice,bob} {carol}` from the raw statement line
+func parsePartitionGroups(line string) ([][]string, error) {
+	var groups [][]string
+	seen := make(map[string]bool)
+	for _, match := range partitionGroupPattern.FindAllStringSubmatch(line, -1) {
+		names := strings.FieldsFunc(match[1], func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(names) == 0 {
+			return nil, fmt.Errorf("partition group {%s} was empty", match[1])
+		}
+		for _, name := range names {
+			if seen[name] {
+				return nil, fmt.Errorf("%s was in more than one partition group", name)
+			}
+			seen[name] = true
+		}
+		groups = append(groups, names)
+	}
+	if len(groups) < 2 {
+		return nil, fmt.Errorf("partition needs at least two groups, e.g. partition {alice,bob} {carol}")
+	}
+	return groups, nil
+}
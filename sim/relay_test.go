@@ -0,0 +1,134 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNetworkConditions(t *testing.T) {
+	a := assert.New(t)
+
+	latencies := []struct {
+		arg  string
+		want time.Duration
+		ok   bool
+	}{
+		{"50ms", 50 * time.Millisecond, true},
+		{"1.5s", 1500 * time.Millisecond, true},
+		{"200", 200 * time.Millisecond, true},
+		{"0", 0, true},
+		{"-5ms", 0, false},
+		{"-5", 0, false},
+		{"fast", 0, false},
+		{"10%", 0, false},
+	}
+	for _, c := range latencies {
+		d, err := parseLatency(c.arg)
+		if c.ok {
+			a.NoError(err, c.arg)
+			a.Equal(c.want, d, c.arg)
+		} else {
+			a.Error(err, c.arg)
+		}
+	}
+
+	droprates := []struct {
+		arg  string
+		want float64
+		ok   bool
+	}{
+		{"10%", 0.1, true},
+		{"0.1", 0.1, true},
+		{"0%", 0, true},
+		{"100%", 1, true},
+		{"1", 1, true},
+		{"150%", 0, false},
+		{"1.5", 0, false},
+		{"-1%", 0, false},
+		{"lots", 0, false},
+	}
+	for _, c := range droprates {
+		rate, err := parseDroprate(c.arg)
+		if c.ok {
+			a.NoError(err, c.arg)
+			a.InDelta(c.want, rate, 1e-9, c.arg)
+		} else {
+			a.Error(err, c.arg)
+		}
+	}
+
+	bandwidths := []struct {
+		arg  string
+		want int64
+		ok   bool
+	}{
+		{"1mbit", 1000 * 1000, true},
+		{"64kbit", 64 * 1000, true},
+		{"20kbps", 160 * 1000, true},
+		{"1.5MBIT", 1500 * 1000, true},
+		{"unlimited", 0, true},
+		{"0", 0, true},
+		{"64", 0, false},
+		{"64kb", 0, false},
+		{"kbit", 0, false},
+	}
+	for _, c := range bandwidths {
+		bitrate, err := parseBandwidth(c.arg)
+		if c.ok {
+			a.NoError(err, c.arg)
+			a.Equal(c.want, bitrate, c.arg)
+		} else {
+			a.Error(err, c.arg)
+		}
+	}
+
+	partitions := []struct {
+		line string
+		want [][]string
+		ok   bool
+	}{
+		{"partition {alice,bob} {carol}", [][]string{{"alice", "bob"}, {"carol"}}, true},
+		{"partition {alice, bob} {carol} {dan}", [][]string{{"alice", "bob"}, {"carol"}, {"dan"}}, true},
+		{"partition a,b | c", nil, false},
+		{"partition {alice,bob}", nil, false},
+		{"partition {alice} {}", nil, false},
+		{"partition {alice,bob} {bob}", nil, false},
+	}
+	for _, c := range partitions {
+		groups, err := parsePartitionGroups(c.line)
+		if c.ok {
+			a.NoError(err, c.line)
+			a.Equal(c.want, groups, c.line)
+		} else {
+			a.Error(err, c.line)
+		}
+	}
+}
+
+func TestRelayLinks(t *testing.T) {
+	a := assert.New(t)
+
+	n := newNetwork()
+	defer n.close()
+	alice, bob := &Puppet{name: "alice"}, &Puppet{name: "bob"}
+	r := n.relayFor(bob)
+
+	// disconnecting a pair that never connected mustn't open a link for it
+	_, ok := r.existingPort(alice)
+	a.False(ok)
+	a.Error(DoDisconnect(alice, &Puppet{name: "bob", relay: r}))
+	_, ok = r.existingPort(alice)
+	a.False(ok)
+
+	port, err := r.portFor(alice)
+	a.NoError(err)
+	existing, ok := r.existingPort(alice)
+	a.True(ok)
+	a.Equal(port, existing)
+}
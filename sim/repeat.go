@@ -0,0 +1,150 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// the highest port a repeated run may continue counting from; beyond it, the next run starts over at --port
+const maxRepeatPort = 60000
+
+// RunRepeatedly runs the test of args the given number of times, to find out which of its statements are flaky. each
+// run gets a fresh puppet directory inside of args.Outdir (run-01, run-02..), and ports that weren't used by the
+// run before it. a table of the outcomes & durations of every statement over all of the runs is printed at the end
+func RunRepeatedly(args Args, sbots []string, times int) []*Report {
+	args.Outdir = puppetDirPath(args.Outdir)
+	requireTAP(args, "--repeat")
+	lines := readTest(args.Testfile)
+	roles, err := bindRoles(findRoles(lines), implementationNames(sbots))
+	if err != nil {
+		bail(err.Error())
+	}
+	preparePuppetDir(args.Outdir)
+
+	ports := new(int)
+	var reports []*Report
+	for i := 0; i < times; i++ {
+		if args.BasePort+*ports > maxRepeatPort {
+			*ports = 0
+		}
+		runArgs := startSubrun(args, fmt.Sprintf("run-%0*d", len(strconv.Itoa(times)), i+1), os.Stdout)
+		taplog(fmt.Sprintf("run %d of %d", i+1, times))
+		report := simulate(runArgs, sbots, lines, roles, ports)
+		reports = append(reports, report)
+		if report.Interrupted {
+			break
+		}
+	}
+	logRepeats(reports)
+	return reports
+}
+
+// statementStats are the outcomes of a single instruction over repeated runs of a test
+type statementStats struct {
+	instr     InstructionReport // as recorded by the first run
+	counts    map[string]int    // the number of runs that ended up with each status
+	durations []time.Duration   // of the runs that executed the instruction
+	retries   int
+}
+
+// flaky reports whether the instruction passed in some runs, but failed or aborted in others
+func (st statementStats) flaky() bool {
+	outcomes := 0
+	for _, status := range []string{StatusOk, StatusNotOk, StatusBailOut} {
+		if st.counts[status] > 0 {
+			outcomes++
+		}
+	}
+	return outcomes > 1
+}
+
+func (st statementStats) position() string {
+	return statement{file: st.instr.File, line: st.instr.Line}.pos()
+}
+
+// aggregateRuns collects the outcomes of each instruction over the reports of repeated runs of the same test
+func aggregateRuns(reports []*Report) []statementStats {
+	var stats []statementStats
+	for _, report := range reports {
+		report.mu.Lock()
+		for i, instr := range report.Instructions {
+			if i == len(stats) {
+				stats = append(stats, statementStats{instr: instr, counts: make(map[string]int)})
+			}
+			st := &stats[i]
+			st.counts[instr.Status]++
+			st.retries += instr.Retries
+			switch instr.Status {
+			case StatusOk, StatusNotOk, StatusBailOut:
+				st.durations = append(st.durations, instr.Duration)
+			}
+		}
+		report.mu.Unlock()
+	}
+	return stats
+}
+
+// percentile returns the p-th percentile of durations, using the nearest-rank method
+func percentile(durations []time.Duration, p float64) time.Duration {
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// logRepeats prints how each statement fared over repeated runs, marking the flaky ones with a *
+func logRepeats(reports []*Report) {
+	if len(reports) == 0 {
+		return
+	}
+	passed := 0
+	for _, report := range reports {
+		if report.Passed() {
+			passed++
+		}
+	}
+	stats := aggregateRuns(reports)
+
+	taplog(fmt.Sprintf("\nOutcome of each statement over %d runs; * marks statements whose outcome varied", len(reports)))
+	fmtString := "%1s %4s %5s %5s %5s %9s %9s %7s  %s"
+	taplog(fmt.Sprintf(fmtString, "", "#", "Pass", "Fail", "Abort", "Median", "p95", "Retries", "Statement"))
+	var flaky []statementStats
+	for _, st := range stats {
+		mark := ""
+		if st.flaky() {
+			mark = "*"
+			flaky = append(flaky, st)
+		}
+		median, p95 := "-", "-"
+		if len(st.durations) > 0 {
+			median = percentile(st.durations, 50).Round(time.Millisecond).String()
+			p95 = percentile(st.durations, 95).Round(time.Millisecond).String()
+		}
+		taplog(fmt.Sprintf(fmtString, mark, strconv.Itoa(st.instr.ID), strconv.Itoa(st.counts[StatusOk]),
+			strconv.Itoa(st.counts[StatusNotOk]), strconv.Itoa(st.counts[StatusBailOut]), median, p95,
+			strconv.Itoa(st.retries), st.instr.Statement))
+	}
+
+	taplog(fmt.Sprintf("%d of %d runs passed", passed, len(reports)))
+	if len(flaky) == 0 {
+		return
+	}
+	taplog(fmt.Sprintf("%d flaky statements:", len(flaky)))
+	for _, st := range flaky {
+		taplog(fmt.Sprintf("%s: %s passed %d, failed %d and aborted %d times, retrying %d times in total",
+			st.position(), st.instr.Statement, st.counts[StatusOk], st.counts[StatusNotOk], st.counts[StatusBailOut], st.retries))
+	}
+}
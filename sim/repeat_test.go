@@ -0,0 +1,61 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregateRuns(t *testing.T) {
+	a := assert.New(t)
+
+	run := func(status string, d time.Duration, retries int) *Report {
+		return &Report{Instructions: []InstructionReport{
+			{ID: 1, Statement: "start alice go-sbot", Status: StatusOk, Duration: time.Second},
+			{ID: 2, Statement: "waituntil alice bob@latest", Status: status, Duration: d, Retries: retries},
+			{ID: 3, Statement: "has alice bob@latest", Status: StatusNotOk},
+		}}
+	}
+	reports := []*Report{
+		run(StatusOk, 2*time.Second, 0),
+		run(StatusNotOk, 10*time.Second, 9),
+		run(StatusOk, 3*time.Second, 1),
+		run(StatusNotRun, 0, 0),
+	}
+	stats := aggregateRuns(reports)
+	a.Len(stats, 3)
+
+	a.Equal(map[string]int{StatusOk: 4}, stats[0].counts)
+	a.False(stats[0].flaky())
+
+	a.Equal(map[string]int{StatusOk: 2, StatusNotOk: 1, StatusNotRun: 1}, stats[1].counts)
+	a.Equal(10, stats[1].retries)
+	// instructions which didn't run don't count towards the durations
+	a.Equal([]time.Duration{2 * time.Second, 10 * time.Second, 3 * time.Second}, stats[1].durations)
+	a.True(stats[1].flaky())
+
+	// failing every time is consistent, not flaky
+	a.Equal(map[string]int{StatusNotOk: 4}, stats[2].counts)
+	a.False(stats[2].flaky())
+
+	one := []time.Duration{7 * time.Second}
+	a.Equal(7*time.Second, percentile(one, 50))
+	a.Equal(7*time.Second, percentile(one, 95))
+
+	// 20 samples of 20s, 19s.. 1s: the nearest rank of p50 is the 10th, and of p95 the 19th
+	var twenty []time.Duration
+	for i := 20; i > 0; i-- {
+		twenty = append(twenty, time.Duration(i)*time.Second)
+	}
+	a.Equal(10*time.Second, percentile(twenty, 50))
+	a.Equal(19*time.Second, percentile(twenty, 95))
+	a.Equal(1*time.Second, percentile(twenty, 0))
+	a.Equal(20*time.Second, percentile(twenty, 100))
+	// the samples themselves are left unsorted
+	a.Equal(20*time.Second, twenty[0])
+}
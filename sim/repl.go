@@ -0,0 +1,501 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+const (
+	replPrompt         = "netsim> "
+	replContinuePrompt = "...     " // shown while a block (`repeat 3 {`, `parallel`) is still open
+	replFile           = "repl"     // the file statements entered in the repl are reported as being written in
+	replTailLines      = 20
+)
+
+// replCommands are the meta commands of the repl, which inspect the session rather than drive the puppets
+var replCommands = map[string]string{
+	".puppets": "list the puppets, with their port, feed id & latest sequence",
+	".tail":    "<name> [lines]: print the last lines of a puppet's log (default 20)",
+	".save":    "<path>: save the statements entered so far as a test file",
+	".help":    "print this help",
+	".quit":    "stop all puppets and exit, as does ctrl-d",
+	".exit":    "same as .quit",
+}
+
+// the keywords that are expanded at parse time, see expand.go, which complete like commands
+var replKeywords = []string{"set", "repeat", "for", "define", "include"}
+
+// repl keeps a simulation running, and executes the statements it reads one input at a time
+type repl struct {
+	sim      Simulator
+	linter   linter
+	expander *expander
+	input    lineReader
+	pending  []statement // the lines of a block which hasn't been closed yet
+	history  []string    // the statements that were executed, as they were entered
+	lines    int         // the number of statements entered so far, which is what positions in the repl refer to
+	ids      int         // the number of instructions executed so far, which the ids of the next ones follow
+
+	mu          sync.Mutex
+	cancelInput context.CancelFunc // stops the execution of the current input; nil while waiting for input
+}
+
+// Repl starts an interactive session against the sbots: each statement read from stdin is executed as soon as it's
+// entered, and its result is printed right away. the puppets are kept running until the session ends
+func Repl(args Args, sbots []string) error {
+	if _, err := base64.StdEncoding.DecodeString(args.Caps); err != nil {
+		return fmt.Errorf("--caps %s was not a valid base64 sequence", args.Caps)
+	}
+	args.Outdir = puppetDirPath(args.Outdir)
+	defaultReporter = newTAPReporter(os.Stdout)
+	defaultReporter.Start()
+	preparePuppetDir(args.Outdir)
+
+	s := makeSimulator(args, sbots)
+	s.interactive = true
+	r := &repl{
+		sim: s,
+		linter: linter{
+			implementations: s.implementations,
+			fixtures:        s.fixtures,
+			fixturesIds:     s.fixturesIds,
+			snapshotDir:     s.snapshotDir,
+			declared:        make(map[string]bool),
+		},
+		expander: newExpander(nil),
+	}
+	r.input = newLineReader(r.completions)
+	r.monitorInterrupts()
+	taplog(fmt.Sprintf("netsim repl with %s; type .help for help", strings.Join(implementationNames(sbots), ", ")))
+	if args.FromSnapshot != "" {
+		if err := s.restoreFrom(args.FromSnapshot); err != nil {
+			r.input.close()
+			s.exit()
+			return fmt.Errorf("--from-snapshot: %w", err)
+		}
+		for _, p := range s.sortedPuppets() {
+			r.linter.declared[p.name] = true
+		}
+	}
+	r.loop()
+	r.input.close()
+
+	defaultReporter.Plan(r.ids)
+	s.exit()
+	return nil
+}
+
+// loop reads input until the session is ended with .quit, ctrl-d or the end of stdin
+func (r *repl) loop() {
+	for {
+		prompt := replPrompt
+		if len(r.pending) > 0 {
+			prompt = replContinuePrompt
+		}
+		line, err := r.input.readLine(prompt)
+		if err != nil {
+			return
+		}
+		text := strings.TrimSpace(line)
+		if text == "" {
+			continue
+		}
+		if len(r.pending) == 0 && strings.HasPrefix(text, ".") {
+			if quit := r.meta(strings.Fields(text)); quit {
+				return
+			}
+			continue
+		}
+		r.lines++
+		r.pending = append(r.pending, statement{text: strings.TrimRight(line, " \t"), file: replFile, line: r.lines})
+		if blockOpen(r.pending) {
+			continue
+		}
+		input := r.pending
+		r.pending = nil
+		r.eval(input)
+	}
+}
+
+// blockOpen reports whether lines end inside of a block, which has to be closed before any of them can be executed
+func blockOpen(lines []statement) bool {
+	depth, parallel := 0, false
+	for _, line := range lines {
+		text := strings.TrimSpace(line.text)
+		switch fields := strings.Fields(text); {
+		case text == "}":
+			depth--
+		case strings.HasSuffix(text, "{"):
+			depth++
+		case fields[0] == "parallel":
+			parallel = true
+		case fields[0] == "end":
+			parallel = false
+		}
+	}
+	return depth > 0 || parallel
+}
+
+// eval expands, lints and executes an input, which is a single statement or a whole block
+func (r *repl) eval(input []statement) {
+	lines := input
+	if fields := strings.Fields(input[0].text); fields[0] == "include" {
+		if len(fields) != 2 {
+			taplog(fmt.Sprintf("%s: expected `include <path>`", input[0].pos()))
+			return
+		}
+		included, err := readTestFile(fields[1], nil)
+		if err != nil {
+			taplog(fmt.Sprintf("%s: could not include %s (%s)", input[0].pos(), fields[1], err))
+			return
+		}
+		lines = included
+	}
+	expanded, err := r.expander.expandLines(lines)
+	if err != nil {
+		taplog(err.Error())
+		return
+	}
+	instructions := make([]Instruction, 0, len(expanded))
+	for i, stmt := range expanded {
+		instr := parseTestLine(strings.TrimSpace(stmt.text), r.ids+i+1)
+		instr.source = stmt
+		instructions = append(instructions, instr)
+	}
+	if problems := r.linter.lint(instructions); len(problems) > 0 {
+		for _, problem := range problems {
+			taplog(problem)
+		}
+		return
+	}
+	for _, stmt := range input {
+		r.history = append(r.history, stmt.text)
+	}
+	r.ids += len(instructions)
+	r.execute(instructions)
+
+	r.sim.mu.Lock()
+	for name := range r.sim.puppetMap {
+		r.linter.declared[name] = true
+	}
+	r.sim.mu.Unlock()
+}
+
+// execute runs the instructions of an input
+func (r *repl) execute(instructions []Instruction) {
+	s := r.sim
+	var cancel context.CancelFunc
+	s.rootCtx, cancel = context.WithCancel(r.sim.rootCtx)
+	s.instructions = instructions
+	r.mu.Lock()
+	r.cancelInput = cancel
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		r.cancelInput = nil
+		r.mu.Unlock()
+		cancel()
+	}()
+
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			// aborts have already been reported by Abort; anything else is a bug, which shouldn't cost the session
+			if _, ok := recovered.(interactiveAbort); !ok {
+				taplog(fmt.Sprintf("panic while executing the input: %v", recovered))
+			}
+		}
+	}()
+	s.executeAll(&Sleeper{sim: s})
+}
+
+// monitorInterrupts makes ctrl-c stop the input being executed, rather than the whole session. otherwise, signals shut
+// the session down like they do a test run
+func (r *repl) monitorInterrupts() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for sig := range c {
+			r.mu.Lock()
+			cancel := r.cancelInput
+			r.mu.Unlock()
+			if cancel != nil && sig == os.Interrupt {
+				taplog("interrupted, stopping the execution of the current input")
+				cancel()
+				continue
+			}
+			taplog(fmt.Sprintf("received shutdown signal, shutting down (signal %s)", sig.String()))
+			r.sim.exit()
+			os.Exit(1)
+		}
+	}()
+}
+
+// meta executes a meta command, returning true if the session should end
+func (r *repl) meta(fields []string) bool {
+	switch fields[0] {
+	case ".quit", ".exit":
+		return true
+	case ".help":
+		r.help()
+	case ".puppets":
+		r.listPuppets()
+	case ".tail":
+		lines := replTailLines
+		if len(fields) == 3 {
+			n, err := strconv.Atoi(fields[2])
+			if err != nil || n < 1 {
+				taplog(fmt.Sprintf("%q was not a number of lines", fields[2]))
+				return false
+			}
+			lines = n
+		} else if len(fields) != 2 {
+			taplog(fmt.Sprintf(".tail %s", replCommands[".tail"]))
+			return false
+		}
+		r.tail(fields[1], lines)
+	case ".save":
+		if len(fields) != 2 {
+			taplog(fmt.Sprintf(".save %s", replCommands[".save"]))
+			return false
+		}
+		r.save(fields[1])
+	default:
+		taplog(fmt.Sprintf("unknown command %s%s; type .help for help", fields[0], suggest(fields[0], mapKeys(replCommands))))
+	}
+	return false
+}
+
+func (r *repl) help() {
+	taplog("Enter any statement of the test language, e.g. `enter alice` or `start alice ssb-server`, to execute it.")
+	taplog("Blocks (`repeat 3 {`, `parallel`) are executed once they're closed. Tab completes commands & puppet names.")
+	names := mapKeys(replCommands)
+	sort.Strings(names)
+	for _, name := range names {
+		taplog(fmt.Sprintf("%-10s %s", name, replCommands[name]))
+	}
+}
+
+// listPuppets prints every puppet of the session. the latest sequence is asked of the sbots of running puppets, and
+// may thus differ from the seqno netsim keeps track of
+func (r *repl) listPuppets() {
+	puppets := r.sim.sortedPuppets()
+	if len(puppets) == 0 {
+		taplog("no puppets have been entered yet")
+		return
+	}
+	fmtString := "%-12s %-16s %-8s %6s %-53s %6s"
+	taplog(fmt.Sprintf(fmtString, "Puppet", "Implementation", "State", "Port", "Feed", "Seqno"))
+	for _, p := range puppets {
+		impl, port, feed, seqno := "-", "-", "-", "-"
+		if p.implementation != "" {
+			impl = p.implementation
+		}
+		if p.port != 0 {
+			port = strconv.Itoa(p.port)
+		}
+		if p.feedID != "" {
+			feed = p.feedID
+		}
+		state := "entered"
+		switch {
+		case p.crashed():
+			state = "crashed"
+		case p.isExecuting():
+			state = "running"
+			if latest, has, err := queryFeedLatest(p, p.feedID); err != nil {
+				seqno = "?"
+			} else if has {
+				seqno = strconv.Itoa(latest.Sequence)
+			} else {
+				seqno = "0"
+			}
+		case p.directory != "":
+			state = "stopped"
+		}
+		taplog(fmt.Sprintf(fmtString, p.name, impl, state, port, feed, seqno))
+	}
+}
+
+func (r *repl) tail(name string, lines int) {
+	r.sim.mu.Lock()
+	_, exists := r.sim.puppetMap[name]
+	r.sim.mu.Unlock()
+	if !exists {
+		taplog(fmt.Sprintf("there is no puppet declared as %s", name))
+		return
+	}
+	tail, err := tailFile(filepath.Join(r.sim.puppetDir, fmt.Sprintf("%s.txt", name)), lines)
+	if err != nil {
+		taplog(fmt.Sprintf("%s has no log yet; it's created when the puppet is started", name))
+		return
+	}
+	taplog(tail)
+}
+
+// save writes the statements that were executed in the session to path, as a test file which replays the session
+func (r *repl) save(path string) {
+	if len(r.history) == 0 {
+		taplog("no statements have been executed yet")
+		return
+	}
+	err := os.WriteFile(path, []byte(strings.Join(r.history, "\n")+"\n"), 0644)
+	if err != nil {
+		taplog(fmt.Sprintf("could not save the session (%s)", err))
+		return
+	}
+	taplog(fmt.Sprintf("saved %d statements to %s", len(r.history), path))
+}
+
+// completions returns the candidates for completing the word that ends the line, along with the offset of that word.
+// the first word of a line completes to a command, and the ones following it to puppet names, or implementations where
+// the command expects one
+func (r *repl) completions(line string) (int, []string) {
+	start := strings.LastIndexAny(line, " \t") + 1
+	word := line[start:]
+	fields := strings.Fields(line[:start])
+
+	var candidates []string
+	if len(fields) == 0 {
+		candidates = append(commandNames(), replKeywords...)
+		if len(r.pending) == 0 {
+			candidates = append(candidates, mapKeys(replCommands)...)
+		}
+	} else if fields[0] == ".tail" || !strings.HasPrefix(fields[0], ".") {
+		kind := argName
+		if spec, ok := commandTable[fields[0]]; ok {
+			switch n := len(fields) - 1; {
+			case n < len(spec.args):
+				kind = spec.args[n]
+			case !spec.rest:
+				kind = argWord
+			}
+		}
+		switch kind {
+		case argName, argSeqno:
+			for _, p := range r.sim.sortedPuppets() {
+				candidates = append(candidates, p.name)
+			}
+		case argImplementation:
+			candidates = mapKeys(r.sim.implementations)
+		}
+	}
+
+	var matches []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, word) {
+			matches = append(matches, candidate)
+		}
+	}
+	sort.Strings(matches)
+	return start, matches
+}
+
+// lineReader reads the input of the repl, one line at a time
+type lineReader interface {
+	readLine(prompt string) (string, error)
+	close()
+}
+
+// newLineReader returns a reader with history & tab completion if stdin is a terminal, and a plain line scanner if it
+// isn't, e.g. when statements are piped into netsim repl
+func newLineReader(completions func(line string) (int, []string)) lineReader {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return &scanReader{scanner: bufio.NewScanner(os.Stdin)}
+	}
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, replPrompt)
+	reader := &terminalReader{fd: fd, terminal: t}
+	t.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		return reader.complete(line, pos, completions)
+	}
+	return reader
+}
+
+type scanReader struct {
+	scanner *bufio.Scanner
+}
+
+// readLine doesn't show the prompt, as nobody is there to read it
+func (s *scanReader) readLine(prompt string) (string, error) {
+	if !s.scanner.Scan() {
+		if err := s.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return s.scanner.Text(), nil
+}
+
+func (s *scanReader) close() {}
+
+// terminalReader reads lines with the line editing, history & completion of golang.org/x/term. the terminal is only
+// put in raw mode while a line is read, so that the output of statements and ctrl-c work as usual while they execute
+type terminalReader struct {
+	fd       int
+	terminal *term.Terminal
+}
+
+func (t *terminalReader) readLine(prompt string) (string, error) {
+	state, err := term.MakeRaw(t.fd)
+	if err != nil {
+		return "", err
+	}
+	defer term.Restore(t.fd, state)
+	t.terminal.SetPrompt(prompt)
+	line, err := t.terminal.ReadLine()
+	if err == term.ErrPasteIndicator {
+		// pasted lines are as good as typed ones
+		err = nil
+	}
+	return line, err
+}
+
+// complete extends the word before the cursor as far as all of its completions agree. if that doesn't get any
+// further, the completions are listed instead
+func (t *terminalReader) complete(line string, pos int, completions func(line string) (int, []string)) (string, int, bool) {
+	start, matches := completions(line[:pos])
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+	completion := matches[0]
+	for _, match := range matches[1:] {
+		for !strings.HasPrefix(match, completion) {
+			completion = completion[:len(completion)-1]
+		}
+	}
+	if len(matches) == 1 {
+		completion += " "
+	}
+	if start+len(completion) == pos {
+		fmt.Fprintf(t.terminal, "%s\n", strings.Join(matches, "  "))
+		return "", 0, false
+	}
+	return line[:start] + completion + line[pos:], start + len(completion), true
+}
+
+func (t *terminalReader) close() {
+	fmt.Fprintln(os.Stdout)
+}
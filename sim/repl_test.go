@@ -0,0 +1,44 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplInput(t *testing.T) {
+	a := assert.New(t)
+
+	a.False(blockOpen(statements("post alice")))
+	a.False(blockOpen(statements("repeat 3 { post alice }")))
+	a.True(blockOpen(statements("repeat 3 {")))
+	a.True(blockOpen(statements("for p in alice bob {\nrepeat 2 {\npost $p\n}")))
+	a.False(blockOpen(statements("for p in alice bob {\nrepeat 2 {\npost $p\n}\n}")))
+	a.True(blockOpen(statements("parallel\npost alice")))
+	a.False(blockOpen(statements("parallel\npost alice\nend")))
+
+	r := &repl{sim: Simulator{
+		puppetMap:       map[string]*Puppet{"alice": {name: "alice"}, "albert": {name: "albert"}, "bob": {name: "bob"}},
+		implementations: map[string]string{"go-sbot": "", "ssb-server": ""},
+		mu:              new(sync.Mutex),
+	}}
+	start, matches := r.completions("wai")
+	a.Equal(0, start)
+	a.Equal([]string{"wait", "waituntil"}, matches)
+	_, matches = r.completions(".pu")
+	a.Equal([]string{".puppets"}, matches)
+	start, matches = r.completions("follow al")
+	a.Equal(7, start)
+	a.Equal([]string{"albert", "alice"}, matches)
+	_, matches = r.completions("start bob ")
+	a.Equal([]string{"go-sbot", "ssb-server"}, matches)
+	_, matches = r.completions("wait ")
+	a.Empty(matches)
+	_, matches = r.completions(".tail b")
+	a.Equal([]string{"bob"}, matches)
+}
@@ -0,0 +1,226 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// the possible outcomes of an instruction, as recorded in the run report
+const (
+	StatusOk      = "ok"
+	StatusNotOk   = "not ok"
+	StatusBailOut = "bail out"
+	StatusSkipped = "skipped" // the instruction wasn't executed, see Error for why
+	StatusNotRun  = "not run" // the simulation ended before the instruction was executed
+)
+
+// InstructionReport records the outcome of a single instruction
+type InstructionReport struct {
+	ID        int      `json:"id"`
+	File      string   `json:"file,omitempty"` // the test file the instruction was written in
+	Line      int      `json:"line"`           // the line of the test file the instruction was written on
+	Statement string   `json:"statement"`
+	Command   string   `json:"command"`
+	Args      []string `json:"args"`
+	Status    string   `json:"status"`
+	// Duration is the wall time spent executing the instruction, including any sleeps
+	Duration   time.Duration `json:"-"`
+	DurationMs int64         `json:"durationMs"`
+	Error      string        `json:"error,omitempty"`
+	// Retries is how many times a failing call was retried, e.g. while waiting for a puppet's sbot to start
+	Retries int `json:"retries,omitempty"`
+}
+
+func (r *InstructionReport) setStatus(status string, err error) {
+	r.Status = status
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+func (r *InstructionReport) setDuration(d time.Duration) {
+	r.Duration = d
+	r.DurationMs = d.Milliseconds()
+}
+
+// PuppetReport contains the totals of a puppet, as printed at the end of a run
+type PuppetReport struct {
+	Name            string `json:"name"`
+	FeedID          string `json:"feedID"`
+	Implementation  string `json:"implementation"`
+	TotalTimeMs     int64  `json:"totalTimeMs"`
+	ActiveTimeMs    int64  `json:"activeTimeMs"`
+	Messages        int    `json:"messages"`
+	Feeds           int    `json:"feeds"`
+	Handshakes      int    `json:"handshakes"`
+	HandshakeTimeMs int64  `json:"handshakeTimeMs"`
+	// Resources is the usage of the puppet's process group over all of its runs; omitted if it was never started
+	Resources *ResourcesReport `json:"resources,omitempty"`
+}
+
+// ResourcesReport is the resource usage of a puppet, see Resources. fields which couldn't be measured on the platform
+// netsim ran on are 0
+type ResourcesReport struct {
+	CPUUserMs    int64 `json:"cpuUserMs"`
+	CPUSysMs     int64 `json:"cpuSysMs"`
+	PeakRSSBytes int64 `json:"peakRssBytes"`
+	OpenFiles    int   `json:"openFiles"`
+	DiskBytes    int64 `json:"diskBytes"`
+}
+
+// TimerReport contains the final elapsed time of a timer started with `timerstart`
+type TimerReport struct {
+	Order     int   `json:"order"`
+	ElapsedMs int64 `json:"elapsedMs"`
+	Running   bool  `json:"running"`
+}
+
+// RunConfig describes how the simulation was set up
+type RunConfig struct {
+	Args            Args              `json:"args"`
+	Implementations map[string]string `json:"implementations"` // implementation folder name => path
+	Caps            string            `json:"caps"`
+	Hops            int               `json:"hops"`
+	// Roles are the implementations bound to the roles used by the test, e.g. IMPL_A => go-sbot
+	Roles map[string]string `json:"roles,omitempty"`
+}
+
+// Report is the machine-readable counterpart to the TAP output of a simulation, written with `netsim run --report`
+type Report struct {
+	Version      string                 `json:"version"`
+	Config       RunConfig              `json:"config"`
+	Started      time.Time              `json:"started"`
+	Finished     time.Time              `json:"finished"`
+	Instructions []InstructionReport    `json:"instructions"`
+	Timers       map[string]TimerReport `json:"timers"`
+	Puppets      []PuppetReport         `json:"puppets"`
+	Traffic      TrafficReport          `json:"traffic"`
+	Interrupted  bool                   `json:"interrupted,omitempty"` // the run was stopped with ctrl-c
+
+	mu sync.Mutex
+}
+
+func newReport(args Args, implementations map[string]string) *Report {
+	return &Report{
+		Version: args.Version,
+		Config: RunConfig{
+			Args:            args,
+			Implementations: implementations,
+			Caps:            args.Caps,
+			Hops:            args.Hops,
+		},
+		Started:      time.Now(),
+		Instructions: []InstructionReport{},
+		Timers:       make(map[string]TimerReport),
+		Puppets:      []PuppetReport{},
+	}
+}
+
+// track creates a report entry for each instruction, and attaches it to the instruction so that its outcome is
+// recorded as it's being executed
+func (r *Report) track(instructions []Instruction) {
+	r.Instructions = make([]InstructionReport, len(instructions))
+	for i := range instructions {
+		instr := &instructions[i]
+		r.Instructions[i] = InstructionReport{
+			ID:        instr.id,
+			File:      instr.source.file,
+			Line:      instr.source.line,
+			Statement: instr.line,
+			Command:   instr.command,
+			Args:      instr.args,
+			Status:    StatusNotRun,
+		}
+		instr.result = &r.Instructions[i]
+	}
+}
+
+func (r *Report) setPuppets(puppets []*Puppet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Puppets = make([]PuppetReport, 0, len(puppets))
+	for _, p := range puppets {
+		var resources *ResourcesReport
+		if usage, ok := p.resources.usage(); ok {
+			resources = &ResourcesReport{
+				CPUUserMs:    usage.CPUUser.Milliseconds(),
+				CPUSysMs:     usage.CPUSys.Milliseconds(),
+				PeakRSSBytes: usage.PeakRSS,
+				OpenFiles:    usage.OpenFiles,
+				DiskBytes:    usage.DiskBytes,
+			}
+		}
+		r.Puppets = append(r.Puppets, PuppetReport{
+			Name:            p.name,
+			FeedID:          p.feedID,
+			Implementation:  p.implementation,
+			TotalTimeMs:     p.totalTime.Milliseconds(),
+			ActiveTimeMs:    (p.totalTime - p.slept).Milliseconds(),
+			Messages:        p.totalMessages,
+			Feeds:           p.totalFeeds,
+			Handshakes:      p.rpc.handshakes,
+			HandshakeTimeMs: p.rpc.handshakeTime.Milliseconds(),
+			Resources:       resources,
+		})
+	}
+	sort.Slice(r.Puppets, func(i, j int) bool {
+		return r.Puppets[i].Name < r.Puppets[j].Name
+	})
+}
+
+func (r *Report) setTimers(timers map[string]*Timer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Timers = make(map[string]TimerReport)
+	for label, timer := range timers {
+		r.Timers[label] = TimerReport{Order: timer.order, ElapsedMs: timer.elapsed.Milliseconds(), Running: timer.running}
+	}
+}
+
+func (r *Report) setTraffic(traffic TrafficReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Traffic = traffic
+}
+
+func (r *Report) setInterrupted() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Interrupted = true
+}
+
+// Counts returns the number of instructions with each status
+func (r *Report) Counts() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := make(map[string]int)
+	for _, instr := range r.Instructions {
+		counts[instr.Status]++
+	}
+	return counts
+}
+
+// Passed reports whether every instruction was executed, and either passed or was skipped
+func (r *Report) Passed() bool {
+	counts := r.Counts()
+	return !r.Interrupted && counts[StatusOk]+counts[StatusSkipped] == len(r.Instructions)
+}
+
+// write persists the report as json to path
+func (r *Report) write(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Finished = time.Now()
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
@@ -0,0 +1,383 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the output formats supported by `netsim run --format`
+const (
+	FormatTAP   = "tap"
+	FormatJUnit = "junit"
+)
+
+// Reporter receives the outcome of every instruction, as well as any diagnostics produced along the way, and renders
+// them in some output format
+type Reporter interface {
+	// Start is called once, before the first instruction is executed
+	Start()
+	Success(instr Instruction)
+	Failure(instr Instruction, err error)
+	// Skip reports an instruction which wasn't executed, e.g. because the puppet's sbot doesn't support it
+	Skip(instr Instruction, reason string)
+	// Abort reports an instruction whose failure ends the simulation
+	Abort(instr Instruction, err error)
+	// Bail reports a problem which ends the simulation before, or outside of, any instruction
+	Bail(msg string)
+	// Diagnostic is a comment related to a specific instruction
+	Diagnostic(instr Instruction, str string)
+	// Comment is a comment about the simulation as a whole
+	Comment(str string)
+	// Plan is called with the number of instructions once all of them have been executed
+	Plan(count int)
+	// Finish is called when the simulation is exiting. it may be called more than once
+	Finish()
+}
+
+// defaultReporter is where the outcomes of instructions are reported, unless the instruction has its own reporter
+var defaultReporter Reporter = newTAPReporter(os.Stdout)
+
+// newReporter returns the reporter for format. logDir is the directory containing the puppet logs
+func newReporter(format string, w io.Writer, suite, logDir string) (Reporter, error) {
+	switch format {
+	case "", FormatTAP:
+		return newTAPReporter(w), nil
+	case FormatJUnit:
+		return newJUnitReporter(w, suite, logDir), nil
+	}
+	return nil, fmt.Errorf("unknown output format %q (expected %s or %s)", format, FormatTAP, FormatJUnit)
+}
+
+// echoWriter is where puppet output is echoed in verbose mode. it's kept off stdout if stdout is being used for
+// anything other than TAP
+func echoWriter() io.Writer {
+	if _, ok := defaultReporter.(*tapReporter); ok {
+		return os.Stdout
+	}
+	return os.Stderr
+}
+
+// tapReporter writes the Test Anything Protocol, as netsim always has
+type tapReporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newTAPReporter(w io.Writer) *tapReporter {
+	return &tapReporter{w: w}
+}
+
+func (t *tapReporter) printf(format string, a ...interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintf(t.w, format, a...)
+}
+
+func (t *tapReporter) Start() {
+	t.printf("TAP version 13\n")
+}
+
+func (t *tapReporter) Success(instr Instruction) {
+	t.printf("ok %d - %s\n", instr.id, instr.statement())
+}
+
+func (t *tapReporter) Failure(instr Instruction, err error) {
+	t.printf("not ok %d - %s\n", instr.id, instr.statement())
+	t.Diagnostic(instr, err.Error())
+}
+
+func (t *tapReporter) Skip(instr Instruction, reason string) {
+	t.printf("ok %d - %s # SKIP %s\n", instr.id, instr.statement(), reason)
+}
+
+func (t *tapReporter) Abort(instr Instruction, err error) {
+	t.printf("Bail out! %s (%s)\n", err.Error(), instr.statement())
+}
+
+func (t *tapReporter) Bail(msg string) {
+	t.printf("Bail out! %s\n", msg)
+}
+
+func (t *tapReporter) Diagnostic(instr Instruction, str string) {
+	t.Comment(str)
+}
+
+func (t *tapReporter) Comment(str string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fprintTaplog(t.w, str)
+}
+
+func (t *tapReporter) Plan(count int) {
+	t.printf("1..%d\n", count)
+}
+
+func (t *tapReporter) Finish() {}
+
+// recorder holds on to everything reported by an instruction, so that it can be replayed to another reporter later.
+// used to keep the output of the instructions of a parallel block in line order
+type recorder struct {
+	events []func(Reporter)
+}
+
+func (r *recorder) add(event func(Reporter)) {
+	r.events = append(r.events, event)
+}
+
+func (r *recorder) replay(to Reporter) {
+	for _, event := range r.events {
+		event(to)
+	}
+	r.events = nil
+}
+
+func (r *recorder) Start() { r.add(func(to Reporter) { to.Start() }) }
+func (r *recorder) Success(instr Instruction) {
+	r.add(func(to Reporter) { to.Success(instr) })
+}
+func (r *recorder) Failure(instr Instruction, err error) {
+	r.add(func(to Reporter) { to.Failure(instr, err) })
+}
+func (r *recorder) Skip(instr Instruction, reason string) {
+	r.add(func(to Reporter) { to.Skip(instr, reason) })
+}
+func (r *recorder) Abort(instr Instruction, err error) {
+	r.add(func(to Reporter) { to.Abort(instr, err) })
+}
+func (r *recorder) Bail(msg string) { r.add(func(to Reporter) { to.Bail(msg) }) }
+func (r *recorder) Diagnostic(instr Instruction, str string) {
+	r.add(func(to Reporter) { to.Diagnostic(instr, str) })
+}
+func (r *recorder) Comment(str string) { r.add(func(to Reporter) { to.Comment(str) }) }
+func (r *recorder) Plan(count int)     { r.add(func(to Reporter) { to.Plan(count) }) }
+func (r *recorder) Finish()            {}
+
+// the number of lines of a puppet's log included with a failing testcase
+const junitLogTail = 20
+
+type junitTestsuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestsuite `xml:"testsuite"`
+}
+
+type junitTestsuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Errors    int             `xml:"errors,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Testcases []junitTestcase `xml:"testcase"`
+	SystemOut string          `xml:"system-out,omitempty"`
+}
+
+type junitTestcase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure `xml:"error,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+// junitCase is a testcase in the making; its duration is only known once the instruction is done
+type junitCase struct {
+	instr    Instruction
+	reported bool
+	testcase junitTestcase
+	output   strings.Builder
+}
+
+// junitReporter collects the outcomes of a simulation, and writes them as JUnit XML once it finishes. the test file
+// is a testsuite, and each instruction a testcase
+type junitReporter struct {
+	mu       sync.Mutex
+	w        io.Writer
+	suite    string
+	logDir   string
+	started  time.Time
+	cases    []*junitCase
+	byID     map[int]*junitCase
+	output   strings.Builder // comments not related to any instruction
+	finished bool
+}
+
+func newJUnitReporter(w io.Writer, suite, logDir string) *junitReporter {
+	return &junitReporter{w: w, suite: suite, logDir: logDir, started: time.Now(), byID: make(map[int]*junitCase)}
+}
+
+// testcase returns the testcase of instr, creating it if it doesn't exist yet. the lock must be held
+func (j *junitReporter) testcase(instr Instruction) *junitCase {
+	c, ok := j.byID[instr.id]
+	if !ok {
+		c = &junitCase{instr: instr}
+		c.testcase.Name = fmt.Sprintf("%d - %s", instr.id, instr.statement())
+		c.testcase.Classname = j.suite
+		j.byID[instr.id] = c
+		j.cases = append(j.cases, c)
+	}
+	return c
+}
+
+func (j *junitReporter) Start() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.started = time.Now()
+}
+
+func (j *junitReporter) Success(instr Instruction) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.testcase(instr).reported = true
+}
+
+func (j *junitReporter) Failure(instr Instruction, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	c := j.testcase(instr)
+	c.reported = true
+	c.testcase.Failure = &junitFailure{Message: firstLine(err.Error()), Type: "TestError", Text: err.Error()}
+	j.appendLogTails(c)
+}
+
+func (j *junitReporter) Skip(instr Instruction, reason string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	c := j.testcase(instr)
+	c.reported = true
+	c.testcase.Skipped = &junitSkipped{Message: reason}
+}
+
+func (j *junitReporter) Abort(instr Instruction, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	c := j.testcase(instr)
+	c.reported = true
+	c.testcase.Error = &junitFailure{Message: firstLine(err.Error()), Type: "BailOut", Text: err.Error()}
+	j.appendLogTails(c)
+}
+
+func (j *junitReporter) Bail(msg string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// there's no instruction to pin a bail out to, so it gets a testcase of its own
+	c := j.testcase(Instruction{id: 0, line: "netsim"})
+	c.reported = true
+	c.testcase.Error = &junitFailure{Message: firstLine(msg), Type: "BailOut", Text: msg}
+}
+
+func (j *junitReporter) Diagnostic(instr Instruction, str string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fprintTaplog(&j.testcase(instr).output, str)
+}
+
+func (j *junitReporter) Comment(str string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fprintTaplog(&j.output, str)
+}
+
+func (j *junitReporter) Plan(count int) {}
+
+// appendLogTails adds the last lines of the logs of every puppet named by the testcase's instruction to its output.
+// the lock must be held
+func (j *junitReporter) appendLogTails(c *junitCase) {
+	for _, name := range c.instr.args {
+		tail, err := tailFile(filepath.Join(j.logDir, fmt.Sprintf("%s.txt", name)), junitLogTail)
+		if err != nil || tail == "" {
+			continue
+		}
+		fmt.Fprintf(&c.output, "--- last lines of %s.txt ---\n%s\n", name, tail)
+	}
+}
+
+func (j *junitReporter) Finish() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.finished {
+		return
+	}
+	j.finished = true
+
+	suite := junitTestsuite{
+		Name:      j.suite,
+		Time:      junitSeconds(time.Since(j.started)),
+		Timestamp: j.started.Format("2006-01-02T15:04:05"),
+		SystemOut: j.output.String(),
+	}
+	for _, c := range j.cases {
+		if !c.reported {
+			// diagnostics of an instruction that never got an outcome, e.g. because the run was interrupted
+			suite.SystemOut += c.output.String()
+			continue
+		}
+		var d time.Duration
+		if c.instr.result != nil {
+			d = c.instr.result.Duration
+		}
+		c.testcase.Time = junitSeconds(d)
+		c.testcase.SystemOut = c.output.String()
+		suite.Tests += 1
+		if c.testcase.Failure != nil {
+			suite.Failures += 1
+		}
+		if c.testcase.Error != nil {
+			suite.Errors += 1
+		}
+		if c.testcase.Skipped != nil {
+			suite.Skipped += 1
+		}
+		suite.Testcases = append(suite.Testcases, c.testcase)
+	}
+
+	b, err := xml.MarshalIndent(junitTestsuites{Suites: []junitTestsuite{suite}}, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not render junit report: %s\n", err)
+		return
+	}
+	fmt.Fprintf(j.w, "%s%s\n", xml.Header, b)
+}
+
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+func firstLine(str string) string {
+	return strings.SplitN(str, "\n", 2)[0]
+}
+
+// tailFile returns the last n lines of the file at path
+func tailFile(path string, n int) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	lines := strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n"), nil
+}
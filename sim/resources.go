@@ -0,0 +1,186 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// how often the resource usage of a running puppet is sampled
+const resourceSampleInterval = time.Second
+
+// Resources is the resource usage of a puppet's process group: the shim, the sbot and whatever else they started
+type Resources struct {
+	CPUUser   time.Duration
+	CPUSys    time.Duration
+	PeakRSS   int64 // bytes; 0 if it couldn't be measured on this platform
+	OpenFiles int   // the most file descriptors the group had open at once; 0 if it couldn't be measured
+	DiskBytes int64 // the size of the puppet's directory, as of the last sample
+}
+
+// groupSample is what's measured of a process group at a single point in time, see sampleGroup
+type groupSample struct {
+	cpuUser   time.Duration
+	cpuSys    time.Duration
+	rss       int64
+	openFiles int
+}
+
+// resourceMonitor accumulates the resource usage of a puppet across all of its runs
+type resourceMonitor struct {
+	mu      sync.Mutex
+	total   Resources   // the usage of the puppet's previous runs
+	run     Resources   // the usage of the current run, as of the last sample
+	last    groupSample // the last sample of the current run
+	sampled bool        // whether any sample has been taken at all
+}
+
+// watch samples the resource usage of proc every resourceSampleInterval, until it exits
+func (m *resourceMonitor) watch(proc *Process, dir string) {
+	pid := proc.cmd.Process.Pid
+	ticker := time.NewTicker(resourceSampleInterval)
+	defer ticker.Stop()
+	for {
+		m.sample(pid, dir)
+		select {
+		case <-proc.done:
+			m.endRun(proc, dir)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *resourceMonitor) sample(pid int, dir string) {
+	sample, err := sampleGroup(pid)
+	disk := dirSize(dir)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sampled = true
+	m.run.DiskBytes = disk
+	if err != nil {
+		return
+	}
+	m.last = sample
+	// processes which exited since the last sample take their cpu time with them, so only ever count upwards
+	m.run.CPUUser = maxDuration(m.run.CPUUser, sample.cpuUser)
+	m.run.CPUSys = maxDuration(m.run.CPUSys, sample.cpuSys)
+	if sample.rss > m.run.PeakRSS {
+		m.run.PeakRSS = sample.rss
+	}
+	if sample.openFiles > m.run.OpenFiles {
+		m.run.OpenFiles = sample.openFiles
+	}
+}
+
+// endRun adds the usage of a run which just ended to the total. the shim's own accounting, which includes the children
+// it waited for, fills in anything that happened after the last sample
+func (m *resourceMonitor) endRun(proc *Process, dir string) {
+	state := proc.cmd.ProcessState
+	disk := dirSize(dir)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	run := m.run
+	if state != nil {
+		run.CPUUser = maxDuration(run.CPUUser, state.UserTime())
+		run.CPUSys = maxDuration(run.CPUSys, state.SystemTime())
+		if rss := exitPeakRSS(state); rss > run.PeakRSS {
+			run.PeakRSS = rss
+		}
+	}
+	run.DiskBytes = disk
+	m.total = m.merge(run)
+	m.run = Resources{}
+	m.last = groupSample{}
+}
+
+// merge combines the total with the usage of a run: cpu time adds up, while the peaks are the highest of either
+func (m *resourceMonitor) merge(run Resources) Resources {
+	merged := m.total
+	merged.CPUUser += run.CPUUser
+	merged.CPUSys += run.CPUSys
+	if run.PeakRSS > merged.PeakRSS {
+		merged.PeakRSS = run.PeakRSS
+	}
+	if run.OpenFiles > merged.OpenFiles {
+		merged.OpenFiles = run.OpenFiles
+	}
+	merged.DiskBytes = run.DiskBytes
+	return merged
+}
+
+// usage returns the resource usage of all of the puppet's runs, including the current one. ok is false if the puppet
+// was never sampled, e.g. because it was never started
+func (m *resourceMonitor) usage() (Resources, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.run == (Resources{}) {
+		return m.total, m.sampled
+	}
+	return m.merge(m.run), m.sampled
+}
+
+// current returns the last sample of the current run, i.e. how much memory & how many file descriptors are in use
+func (m *resourceMonitor) current() groupSample {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.last
+}
+
+// dirSize returns the total size of the files in dir
+func dirSize(dir string) int64 {
+	var size int64
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// files may come and go while the sbot is running
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// logResources prints the resource usage of each puppet that was started. measurements which aren't supported on
+// this platform are shown as -
+func logResources(puppets []*Puppet) {
+	fmtString := "%-12s %12s %12s %10s %10s %10s"
+	header := false
+	for _, puppet := range puppets {
+		usage, ok := puppet.resources.usage()
+		if !ok {
+			continue
+		}
+		if !header {
+			taplog("\nResource usage of each puppet's process group")
+			taplog(fmt.Sprintf(fmtString, "Puppet", "CPU user", "CPU sys", "Peak RSS", "Open files", "Disk"))
+			header = true
+		}
+		rss, files := "-", "-"
+		if usage.PeakRSS > 0 {
+			rss = formatBytes(usage.PeakRSS)
+		}
+		if usage.OpenFiles > 0 {
+			files = fmt.Sprint(usage.OpenFiles)
+		}
+		taplog(fmt.Sprintf(fmtString, puppet.name, usage.CPUUser.Truncate(time.Millisecond),
+			usage.CPUSys.Truncate(time.Millisecond), rss, files, formatBytes(usage.DiskBytes)))
+	}
+}
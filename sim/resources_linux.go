@@ -0,0 +1,97 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+//go:build linux
+// +build linux
+
+package sim
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// clockTicks is the unit of the cpu times in /proc/<pid>/stat. it is configurable in theory, but 100 on every linux
+// netsim runs on in practice, and reading the actual value requires cgo
+const clockTicks = 100
+
+// sampleGroup measures the processes of the group led by pgid, using /proc
+func sampleGroup(pgid int) (groupSample, error) {
+	var sample groupSample
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return sample, err
+	}
+	pageSize := int64(os.Getpagesize())
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := readProcStat(pid)
+		if err != nil || stat.pgrp != pgid {
+			continue
+		}
+		// the cpu time of children which have been waited for is added to their parent's cutime & cstime, so that
+		// the time of e.g. a build step run by the shim isn't lost when it exits
+		sample.cpuUser += ticksToDuration(stat.utime + stat.cutime)
+		sample.cpuSys += ticksToDuration(stat.stime + stat.cstime)
+		sample.rss += stat.rss * pageSize
+		fds, err := os.ReadDir(filepath.Join("/proc", entry.Name(), "fd"))
+		if err == nil {
+			sample.openFiles += len(fds)
+		}
+	}
+	return sample, nil
+}
+
+type procStat struct {
+	pgrp                         int
+	utime, stime, cutime, cstime int64
+	rss                          int64 // pages
+}
+
+// readProcStat parses the fields of /proc/<pid>/stat that sampleGroup needs, see proc(5)
+func readProcStat(pid int) (procStat, error) {
+	b, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return procStat{}, err
+	}
+	// the second field is the command name in parentheses, which may itself contain spaces and parentheses
+	line := string(b)
+	fields := strings.Fields(line[strings.LastIndexByte(line, ')')+1:])
+	// fields[0] is field 3 of the stat line (state)
+	field := func(n int) int64 {
+		if n-3 >= len(fields) {
+			return 0
+		}
+		v, _ := strconv.ParseInt(fields[n-3], 10, 64)
+		return v
+	}
+	return procStat{
+		pgrp:   int(field(5)),
+		utime:  field(14),
+		stime:  field(15),
+		cutime: field(16),
+		cstime: field(17),
+		rss:    field(24),
+	}, nil
+}
+
+func ticksToDuration(ticks int64) time.Duration {
+	return time.Duration(ticks) * time.Second / clockTicks
+}
+
+// exitPeakRSS returns the peak resident set size of an exited process, or of the largest of the children it waited
+// for
+func exitPeakRSS(state *os.ProcessState) int64 {
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		return rusage.Maxrss * 1024 // kilobytes on linux
+	}
+	return 0
+}
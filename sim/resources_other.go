@@ -0,0 +1,23 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+//go:build !linux
+// +build !linux
+
+package sim
+
+import (
+	"errors"
+	"os"
+)
+
+// sampleGroup is only supported on linux, where the processes of a group can be measured with /proc. elsewhere, cpu
+// time is only known once a puppet exits, and peak rss & open files not at all
+func sampleGroup(pgid int) (groupSample, error) {
+	return groupSample{}, errors.New("measuring running processes is only supported on linux")
+}
+
+func exitPeakRSS(state *os.ProcessState) int64 {
+	return 0
+}
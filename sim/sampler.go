@@ -0,0 +1,228 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sample is a measurement of a single running puppet, taken every --sample-interval during a run
+type Sample struct {
+	ElapsedMs   int64  `json:"elapsedMs"`   // time since the simulation started
+	Instruction int    `json:"instruction"` // the id of the instruction being executed; a parallel block counts as one
+	Line        string `json:"line"`
+	Puppet      string `json:"puppet"`
+	Messages    int    `json:"messages"` // the sum of the latest sequences of the feeds the puppet stores
+	Feeds       int    `json:"feeds"`
+	CPUUserMs   int64  `json:"cpuUserMs"`
+	CPUSysMs    int64  `json:"cpuSysMs"`
+	RSSBytes    int64  `json:"rssBytes"`
+	OpenFiles   int    `json:"openFiles"`
+	DiskBytes   int64  `json:"diskBytes"`
+	Error       string `json:"error,omitempty"` // set if the puppet's latest sequences couldn't be queried
+}
+
+var sampleColumns = []string{"elapsedMs", "instruction", "line", "puppet", "messages", "feeds", "cpuUserMs",
+	"cpuSysMs", "rssBytes", "openFiles", "diskBytes", "error"}
+
+func (sample Sample) record() []string {
+	return []string{
+		strconv.FormatInt(sample.ElapsedMs, 10), strconv.Itoa(sample.Instruction), sample.Line, sample.Puppet,
+		strconv.Itoa(sample.Messages), strconv.Itoa(sample.Feeds), strconv.FormatInt(sample.CPUUserMs, 10),
+		strconv.FormatInt(sample.CPUSysMs, 10), strconv.FormatInt(sample.RSSBytes, 10), strconv.Itoa(sample.OpenFiles),
+		strconv.FormatInt(sample.DiskBytes, 10), sample.Error,
+	}
+}
+
+// sampleWriter writes samples as csv, or as newline delimited json if the file is named .ndjson or .jsonl
+type sampleWriter struct {
+	file *os.File
+	buf  *bufio.Writer
+	csv  *csv.Writer // nil when writing ndjson
+}
+
+func newSampleWriter(path string) (*sampleWriter, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &sampleWriter{file: file, buf: bufio.NewWriter(file)}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ndjson", ".jsonl":
+	default:
+		w.csv = csv.NewWriter(w.buf)
+		err = w.csv.Write(sampleColumns)
+	}
+	return w, err
+}
+
+func (w *sampleWriter) write(sample Sample) error {
+	if w.csv != nil {
+		return w.csv.Write(sample.record())
+	}
+	b, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w.buf, "%s\n", b)
+	return err
+}
+
+// flush makes the samples written so far available to anyone reading the file during the run
+func (w *sampleWriter) flush() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	}
+	return w.buf.Flush()
+}
+
+func (w *sampleWriter) close() error {
+	err := w.flush()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// sampler periodically records the replication progress and resource usage of every running puppet, so that e.g. how
+// quickly a puppet catches up after a `connect` can be plotted
+type sampler struct {
+	sim      Simulator
+	interval time.Duration
+	path     string
+	w        *sampleWriter
+	started  time.Time
+
+	mu      sync.Mutex
+	current Instruction // the top-level instruction being executed
+
+	stopOnce sync.Once
+	quit     chan struct{}
+	done     chan struct{}
+}
+
+func newSampler(s Simulator, interval time.Duration, path string) (*sampler, error) {
+	w, err := newSampleWriter(path)
+	if err != nil {
+		return nil, err
+	}
+	return &sampler{sim: s, interval: interval, path: path, w: w, quit: make(chan struct{}), done: make(chan struct{})}, nil
+}
+
+func (sp *sampler) setInstruction(instr Instruction) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.current = instr
+}
+
+func (sp *sampler) start() {
+	sp.started = time.Now()
+	taplog(fmt.Sprintf("sampling running puppets every %s to %s", sp.interval, sp.path))
+	go func() {
+		defer close(sp.done)
+		ticker := time.NewTicker(sp.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-sp.quit:
+				return
+			case <-ticker.C:
+				// samples which take longer than the interval, e.g. because a puppet has to scan its whole log,
+				// simply make the ticker drop ticks
+				sp.sample()
+			}
+		}
+	}()
+}
+
+// sample measures every running puppet concurrently, and writes the samples in the order of the puppets' names
+func (sp *sampler) sample() {
+	elapsed := time.Since(sp.started)
+	sp.mu.Lock()
+	instr := sp.current
+	sp.mu.Unlock()
+
+	// the instructions start and stop puppets while they're being sampled, so only the state the puppets' sessions keep
+	// behind their own locks is read here
+	sp.sim.mu.Lock()
+	var puppets []*Puppet
+	for _, p := range sp.sim.puppetMap {
+		if p.rpc.running() {
+			puppets = append(puppets, p)
+		}
+	}
+	sp.sim.mu.Unlock()
+	sort.Slice(puppets, func(i, j int) bool {
+		return puppets[i].name < puppets[j].name
+	})
+
+	samples := make([]Sample, len(puppets))
+	var wg sync.WaitGroup
+	for i, p := range puppets {
+		wg.Add(1)
+		go func(i int, p *Puppet) {
+			defer wg.Done()
+			samples[i] = measurePuppet(p)
+		}(i, p)
+	}
+	wg.Wait()
+
+	for _, sample := range samples {
+		sample.ElapsedMs = elapsed.Milliseconds()
+		sample.Instruction = instr.id
+		sample.Line = instr.line
+		if err := sp.w.write(sample); err != nil {
+			taplog(fmt.Sprintf("failed to write sample to %s (%s)", sp.path, err))
+			return
+		}
+	}
+	if err := sp.w.flush(); err != nil {
+		taplog(fmt.Sprintf("failed to write samples to %s (%s)", sp.path, err))
+	}
+}
+
+func measurePuppet(p *Puppet) Sample {
+	sample := Sample{Puppet: p.name}
+	latest, err := queryLatest(p)
+	if err != nil {
+		sample.Error = err.Error()
+	}
+	for _, l := range latest {
+		sample.Messages += l.Sequence
+	}
+	sample.Feeds = len(latest)
+	usage, _ := p.resources.usage()
+	current := p.resources.current()
+	sample.CPUUserMs = usage.CPUUser.Milliseconds()
+	sample.CPUSysMs = usage.CPUSys.Milliseconds()
+	sample.RSSBytes = current.rss
+	sample.OpenFiles = current.openFiles
+	sample.DiskBytes = usage.DiskBytes
+	return sample
+}
+
+// stop ends the sampling, waiting for a sample in progress to be written. it may be called more than once
+func (sp *sampler) stop() {
+	sp.stopOnce.Do(func() {
+		close(sp.quit)
+		<-sp.done
+		if err := sp.w.close(); err != nil {
+			taplog(fmt.Sprintf("failed to write samples to %s (%s)", sp.path, err))
+		}
+	})
+}
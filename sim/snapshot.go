@@ -0,0 +1,308 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// the name of the file describing the puppets of a snapshot, next to the copies of their directories
+const snapshotManifestFile = "snapshot.json"
+
+// labels name the folder of a snapshot, and so can't contain path separators
+var snapshotLabelPattern = regexp.MustCompile(`^[\w.-]+$`)
+
+// snapshotManifest describes the state of every puppet of a simulation at the time of a snapshot
+type snapshotManifest struct {
+	Label   string           `json:"label"`
+	Created time.Time        `json:"created"`
+	Puppets []puppetSnapshot `json:"puppets"`
+}
+
+// puppetSnapshot is the state of a single puppet. its directory is copied into the snapshot as Directory
+type puppetSnapshot struct {
+	Name           string `json:"name"`
+	Implementation string `json:"implementation,omitempty"` // empty if the puppet was never started
+	Directory      string `json:"directory,omitempty"`      // relative to the snapshot; empty if it was never started
+	Running        bool   `json:"running"`
+	FeedID         string `json:"feedID,omitempty"`
+	Seqno          int    `json:"seqno"`
+	Hops           int    `json:"hops"`
+	Caps           string `json:"caps"`
+	SecretDir      string `json:"secretDir,omitempty"` // the fixtures folder the puppet loaded its identity from
+	OmitOffset     bool   `json:"omitOffset,omitempty"`
+	AllOffsets     bool   `json:"allOffsets,omitempty"`
+	IdentitySeed   string `json:"identitySeed,omitempty"`
+}
+
+// snapshotDirPath returns the absolute path of the folder containing the snapshots, ./snapshots unless dir is passed.
+// it's kept apart from --out, which is emptied at the start of every run
+func snapshotDirPath(dir string) string {
+	if dir == "" {
+		dir = "snapshots"
+	}
+	absdir, err := filepath.Abs(dir)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return absdir
+}
+
+func snapshotPath(dir, label string) (string, error) {
+	if !snapshotLabelPattern.MatchString(label) {
+		return "", fmt.Errorf("snapshot label %q may only contain letters, digits, _, - and .", label)
+	}
+	return filepath.Join(dir, label), nil
+}
+
+// readSnapshotManifest reads the manifest of the snapshot named label in dir
+func readSnapshotManifest(dir, label string) (snapshotManifest, error) {
+	var manifest snapshotManifest
+	path, err := snapshotPath(dir, label)
+	if err != nil {
+		return manifest, err
+	}
+	b, err := os.ReadFile(filepath.Join(path, snapshotManifestFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return manifest, fmt.Errorf("there is no snapshot %s in %s", label, dir)
+	}
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return manifest, fmt.Errorf("could not read snapshot %s (%w)", label, err)
+	}
+	return manifest, nil
+}
+
+// names returns the set of the puppets in the snapshot
+func (m snapshotManifest) names() map[string]bool {
+	names := make(map[string]bool)
+	for _, snap := range m.Puppets {
+		names[snap.Name] = true
+	}
+	return names
+}
+
+// snapshot stops every running puppet, so that its sbot leaves its database in a consistent state, and copies the
+// directories & settings of all puppets into the snapshot named label. the puppets that were running are started
+// again afterwards
+func (s Simulator) snapshot(instr Instruction, label string, sleeper *Sleeper) error {
+	dir, err := snapshotPath(s.snapshotDir, label)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+
+	manifest := snapshotManifest{Label: label, Created: time.Now()}
+	var running []*Puppet
+	for _, p := range s.sortedPuppets() {
+		snap := puppetSnapshot{
+			Name:           p.name,
+			Implementation: p.implementation,
+			FeedID:         p.feedID,
+			Seqno:          p.seqno,
+			Hops:           p.hops,
+			Caps:           p.caps,
+			SecretDir:      p.secretDir,
+			OmitOffset:     p.omitOffset,
+			AllOffsets:     p.allOffsets,
+			IdentitySeed:   p.identitySeed,
+		}
+		if p.isExecuting() {
+			if err := p.stop(instr); err != nil {
+				return err
+			}
+			p.stopTimer()
+			snap.Running = true
+			running = append(running, p)
+		}
+		if p.directory != "" {
+			snap.Directory = filepath.Base(p.directory)
+			if err := copyDir(p.directory, filepath.Join(dir, snap.Directory)); err != nil {
+				return fmt.Errorf("could not copy %s's directory (%w)", p.name, err)
+			}
+		}
+		manifest.Puppets = append(manifest.Puppets, snap)
+	}
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, snapshotManifestFile), b, 0644); err != nil {
+		return err
+	}
+	instr.taplog(fmt.Sprintf("saved %d puppets to %s", len(manifest.Puppets), dir))
+
+	for _, p := range running {
+		if err := s.launchPuppet(instr, p, p.implementation, sleeper); err != nil {
+			return fmt.Errorf("%s could not be started again after the snapshot (%w)", p.name, err)
+		}
+	}
+	return nil
+}
+
+// readSnapshot reads the manifest of the snapshot named label, making sure that the simulator has the implementations
+// its puppets ran
+func (s Simulator) readSnapshot(label string) (snapshotManifest, error) {
+	manifest, err := readSnapshotManifest(s.snapshotDir, label)
+	if err != nil {
+		return manifest, err
+	}
+	for _, snap := range manifest.Puppets {
+		if _, ok := s.implementations[snap.Implementation]; snap.Implementation != "" && !ok {
+			return manifest, fmt.Errorf("snapshot %s has puppet %s running %s, which wasn't passed to netsim", label, snap.Name, snap.Implementation)
+		}
+	}
+	return manifest, nil
+}
+
+// restore brings back the puppets of the snapshot named label: their directories and settings are replaced with those
+// of the snapshot, and the puppets that were running when it was taken are started. puppets which aren't part of the
+// snapshot are stopped
+func (s Simulator) restore(instr Instruction, label string, sleeper *Sleeper) error {
+	manifest, err := s.readSnapshot(label)
+	if err != nil {
+		return err
+	}
+	dir, _ := snapshotPath(s.snapshotDir, label)
+	for _, p := range s.sortedPuppets() {
+		if p.isExecuting() {
+			if err := p.stop(instr); err != nil {
+				return err
+			}
+			p.stopTimer()
+		}
+	}
+
+	var running []*Puppet
+	for _, snap := range manifest.Puppets {
+		s.mu.Lock()
+		p, exists := s.puppetMap[snap.Name]
+		s.mu.Unlock()
+		if !exists {
+			p = s.enterPuppet(snap.Name)
+		}
+		p.feedID, p.seqno = snap.FeedID, snap.Seqno
+		p.hops, p.caps = snap.Hops, snap.Caps
+		p.secretDir, p.omitOffset, p.allOffsets = snap.SecretDir, snap.OmitOffset, snap.AllOffsets
+		p.identitySeed, p.secret = snap.IdentitySeed, "" // the secret of a seeded identity is written again on start
+		p.implementation = snap.Implementation
+
+		if p.directory != "" {
+			if err := os.RemoveAll(p.directory); err != nil {
+				return err
+			}
+			p.directory = ""
+		}
+		if snap.Directory != "" {
+			p.directory = filepath.Join(s.puppetDir, snap.Directory)
+			if err := os.RemoveAll(p.directory); err != nil {
+				return err
+			}
+			if err := copyDir(filepath.Join(dir, snap.Directory), p.directory); err != nil {
+				return fmt.Errorf("could not restore %s's directory (%w)", p.name, err)
+			}
+		}
+		if snap.Running {
+			running = append(running, p)
+		}
+	}
+	instr.taplog(fmt.Sprintf("restored %d puppets from %s", len(manifest.Puppets), dir))
+
+	for _, p := range running {
+		if err := s.launchPuppet(instr, p, p.implementation, sleeper); err != nil {
+			return fmt.Errorf("%s could not be started from the snapshot (%w)", p.name, err)
+		}
+		instr.taplog(fmt.Sprintf("%s is at seqno %d, with %d messages", p.name, p.seqno, p.totalMessages))
+	}
+	return nil
+}
+
+// restoreFrom restores the snapshot named label before the test is run, for --from-snapshot. its output is reported
+// outside of any of the test's instructions
+func (s Simulator) restoreFrom(label string) error {
+	instr := Instruction{command: "restore", args: []string{label}, line: "restore " + label, origin: "--from-snapshot"}
+	return s.restore(instr, label, &Sleeper{sim: s})
+}
+
+// sortedPuppets returns the puppets of the simulation, sorted by name
+func (s Simulator) sortedPuppets() []*Puppet {
+	s.mu.Lock()
+	puppets := make([]*Puppet, 0, len(s.puppetMap))
+	for _, p := range s.puppetMap {
+		puppets = append(puppets, p)
+	}
+	s.mu.Unlock()
+	sort.Slice(puppets, func(i, j int) bool {
+		return puppets[i].name < puppets[j].name
+	})
+	return puppets
+}
+
+// copyDir copies the directory src to dst, keeping the permissions of its files; sbots are picky about those of their
+// secrets
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case !d.Type().IsRegular():
+			// sockets & the like are recreated by the sbot
+			return nil
+		}
+		return copyFile(path, target, info.Mode().Perm())
+	})
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
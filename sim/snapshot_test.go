@@ -0,0 +1,47 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshot(t *testing.T) {
+	a := assert.New(t)
+
+	src := filepath.Join(t.TempDir(), "go-sbot-alice")
+	a.NoError(os.MkdirAll(filepath.Join(src, "log"), 0700))
+	a.NoError(os.WriteFile(filepath.Join(src, "secret"), []byte("secret"), 0600))
+	a.NoError(os.WriteFile(filepath.Join(src, "log", "offset"), []byte("log"), 0644))
+	dst := filepath.Join(t.TempDir(), "copy")
+	a.NoError(copyDir(src, dst))
+	info, err := os.Stat(filepath.Join(dst, "secret"))
+	a.NoError(err)
+	a.Equal(os.FileMode(0600), info.Mode().Perm())
+	b, err := os.ReadFile(filepath.Join(dst, "log", "offset"))
+	a.NoError(err)
+	a.Equal("log", string(b))
+
+	// the puppets of a snapshot taken in an earlier run count as entered once it's restored
+	dir := t.TempDir()
+	a.NoError(os.MkdirAll(filepath.Join(dir, "before"), 0700))
+	manifest, err := json.Marshal(snapshotManifest{Label: "before", Puppets: []puppetSnapshot{{Name: "alice"}}})
+	a.NoError(err)
+	a.NoError(os.WriteFile(filepath.Join(dir, "before", snapshotManifestFile), manifest, 0644))
+	lint := func(test string) []string {
+		l := linter{snapshotDir: dir}
+		return l.lint(makeInstructions("", statements(test)))
+	}
+	a.Empty(lint("restore before\npost alice"))
+	a.Len(lint("post alice\nrestore before"), 1)
+	a.Empty(lint("enter bob\nsnapshot after\nrestore after\npost bob"))
+	a.Len(lint("restore after"), 1)
+	a.Len(lint("snapshot ../before"), 1)
+}
@@ -0,0 +1,177 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// trafficCounter counts the bytes and packets (i.e. chunks of data, as read off the socket) that flowed in one
+// direction of a relayed session. it is updated concurrently by the relay, so its fields are only accessed atomically
+type trafficCounter struct {
+	bytes   int64
+	packets int64
+}
+
+func (c *trafficCounter) add(n int) {
+	if n <= 0 {
+		return
+	}
+	atomic.AddInt64(&c.bytes, int64(n))
+	atomic.AddInt64(&c.packets, 1)
+}
+
+// trafficSession accounts for everything that went through a single relayed connection, i.e. everything replicated
+// between a `connect` and its `disconnect` (or until either of the puppets stopped)
+type trafficSession struct {
+	from, to string // from dialed to
+	started  time.Time
+	sent     trafficCounter // from -> to
+	received trafficCounter // to -> from
+
+	mu    sync.Mutex
+	ended time.Time
+}
+
+func (t *trafficSession) end() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ended = time.Now()
+}
+
+// TrafficRecord is a snapshot of a relayed session, from the point of view of the dialing puppet
+type TrafficRecord struct {
+	From            string     `json:"from"`
+	To              string     `json:"to"`
+	Started         time.Time  `json:"started"`
+	Ended           *time.Time `json:"ended,omitempty"` // nil if the session was still active when the snapshot was taken
+	BytesSent       int64      `json:"bytesSent"`
+	BytesReceived   int64      `json:"bytesReceived"`
+	PacketsSent     int64      `json:"packetsSent"`
+	PacketsReceived int64      `json:"packetsReceived"`
+}
+
+func (t *trafficSession) snapshot() TrafficRecord {
+	record := TrafficRecord{
+		From:            t.from,
+		To:              t.to,
+		Started:         t.started,
+		BytesSent:       atomic.LoadInt64(&t.sent.bytes),
+		BytesReceived:   atomic.LoadInt64(&t.received.bytes),
+		PacketsSent:     atomic.LoadInt64(&t.sent.packets),
+		PacketsReceived: atomic.LoadInt64(&t.received.packets),
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.ended.IsZero() {
+		ended := t.ended
+		record.Ended = &ended
+	}
+	return record
+}
+
+// TrafficTotal sums up all sessions a puppet (From) initiated with another puppet (To)
+type TrafficTotal struct {
+	From            string `json:"from"`
+	To              string `json:"to"`
+	Sessions        int    `json:"sessions"`
+	BytesSent       int64  `json:"bytesSent"`
+	BytesReceived   int64  `json:"bytesReceived"`
+	PacketsSent     int64  `json:"packetsSent"`
+	PacketsReceived int64  `json:"packetsReceived"`
+}
+
+// TrafficReport contains the traffic of every relayed session of a simulation, as well as the per-pair totals
+type TrafficReport struct {
+	Sessions []TrafficRecord `json:"sessions"`
+	Totals   []TrafficTotal  `json:"totals"`
+}
+
+func (n *network) recordSession(from, to string) *trafficSession {
+	t := &trafficSession{from: from, to: to, started: time.Now()}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.traffic = append(n.traffic, t)
+	return t
+}
+
+func (n *network) trafficReport() TrafficReport {
+	n.mu.Lock()
+	sessions := n.traffic
+	n.mu.Unlock()
+
+	report := TrafficReport{Sessions: make([]TrafficRecord, 0, len(sessions)), Totals: []TrafficTotal{}}
+	totals := make(map[[2]string]*TrafficTotal)
+	for _, session := range sessions {
+		record := session.snapshot()
+		report.Sessions = append(report.Sessions, record)
+		key := [2]string{record.From, record.To}
+		total, ok := totals[key]
+		if !ok {
+			total = &TrafficTotal{From: record.From, To: record.To}
+			totals[key] = total
+		}
+		total.Sessions += 1
+		total.BytesSent += record.BytesSent
+		total.BytesReceived += record.BytesReceived
+		total.PacketsSent += record.PacketsSent
+		total.PacketsReceived += record.PacketsReceived
+	}
+	for _, total := range totals {
+		report.Totals = append(report.Totals, *total)
+	}
+	// sort by the total amount of bytes exchanged, descending
+	sort.Slice(report.Totals, func(i, j int) bool {
+		a, b := report.Totals[i], report.Totals[j]
+		if a.BytesSent+a.BytesReceived != b.BytesSent+b.BytesReceived {
+			return a.BytesSent+a.BytesReceived > b.BytesSent+b.BytesReceived
+		}
+		return a.From+a.To < b.From+b.To
+	})
+	return report
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func logTraffic(report TrafficReport) {
+	if len(report.Totals) == 0 {
+		return
+	}
+	taplog("\nTraffic between puppets (from the point of view of the connecting puppet)")
+	fmtString := "%-12s %-12s %8s %10s %10s %10s %10s"
+	taplog(fmt.Sprintf(fmtString, "From", "To", "Sessions", "Sent", "Received", "Pkts sent", "Pkts recv"))
+	for _, total := range report.Totals {
+		taplog(fmt.Sprintf(fmtString, total.From, total.To, fmt.Sprint(total.Sessions),
+			formatBytes(total.BytesSent), formatBytes(total.BytesReceived),
+			fmt.Sprint(total.PacketsSent), fmt.Sprint(total.PacketsReceived)))
+	}
+}
+
+// writeTrafficReport persists the traffic report as json to <dir>/traffic.json
+func writeTrafficReport(report TrafficReport, dir string) error {
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "traffic.json"), b, 0644)
+}
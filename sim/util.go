@@ -7,11 +7,13 @@ package sim
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/ssb-ngi-pointer/netsim/internal/parser"
 )
 
 func trimFeedId(feedID string) string {
@@ -19,18 +21,23 @@ func trimFeedId(feedID string) string {
 	return strings.ReplaceAll(s, ".ed25519", "")
 }
 
-func multiserverAddr(p *Puppet) string {
+// multiserverAddr returns the address of puppet p, when reached on the passed in port (typically that of a relay link)
+func multiserverAddr(p *Puppet, port int) string {
 	// format: net:localhost:18889~shs:xDPgE3tTTIwkt1po+2GktzdvwJLS37ZEd+TZzIs66UU=
 	ip := "localhost"
-	return fmt.Sprintf("net:%s:%d~shs:%s", ip, p.port, trimFeedId(p.feedID))
+	return fmt.Sprintf("net:%s:%d~shs:%s", ip, port, trimFeedId(p.feedID))
 }
 
 func taplog(str string) {
+	defaultReporter.Comment(str)
+}
+
+func fprintTaplog(w io.Writer, str string) {
 	if str == "" {
 		return
 	}
 	for _, line := range strings.Split(str, "\n") {
-		fmt.Printf("# %s\n", line)
+		fmt.Fprintf(w, "# %s\n", line)
 	}
 }
 
@@ -48,26 +55,113 @@ func parseTestLine(line string, id int) Instruction {
 	return Instruction{command: parts[0], args: parts[1:], line: line, id: id}
 }
 
-func readTest(filename string) []string {
+// rawArgs returns the text of a statement line following its first skip fields, as written (parseTestLine drops the
+// commas), along with its offset into the line
+func rawArgs(line string, skip int) (string, int) {
+	offset := 0
+	for i := 0; i < skip; i++ {
+		rest := line[offset:]
+		trimmed := strings.TrimLeft(rest, " \t")
+		offset += len(rest) - len(trimmed)
+		if end := strings.IndexAny(trimmed, " \t"); end != -1 {
+			offset += end
+		} else {
+			offset += len(trimmed)
+		}
+	}
+	rest := line[offset:]
+	trimmed := strings.TrimLeft(rest, " \t")
+	return trimmed, offset + len(rest) - len(trimmed)
+}
+
+// parseMessage parses the message written in the publish syntax following the first skip fields of the statement, e.g.
+// `publish <name> <message>`. syntax errors point at the column of the statement
+func parseMessage(instr Instruction, skip int) (map[string]interface{}, error) {
+	content, offset := rawArgs(instr.line, skip)
+	msg, err := parser.Parse(content)
+	var syntaxErr parser.Error
+	if errors.As(err, &syntaxErr) {
+		syntaxErr.Column += offset
+		return nil, fmt.Errorf("%s had a malformed message (%w)", instr.command, syntaxErr)
+	}
+	return msg, err
+}
+
+// readTest returns the non-empty lines of the test file, along with their positions. the contents of included files
+// are read in place of their `include` statements
+func readTest(filename string) []statement {
 	_, err := os.Stat(filename)
 	if errors.Is(err, os.ErrNotExist) {
 		bail(fmt.Sprintf("test file %s not found", filename))
 	}
+	lines, err := readTestFile(filename, nil)
+	if err != nil {
+		bail(err.Error())
+	}
+	return lines
+}
+
+// readTestFile reads filename, which was included by the files in the including chain
+func readTestFile(filename string, including []string) ([]statement, error) {
 	absfilename, err := filepath.Abs(filename)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
+	including = append(including[:len(including):len(including)], absfilename)
 	testfile, err := ioutil.ReadFile(absfilename)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
-	var lines []string
-	for _, line := range strings.Split(string(testfile), "\n") {
+	var lines []statement
+	for i, line := range strings.Split(string(testfile), "\n") {
 		line = strings.TrimSpace(line)
 		if len(line) == 0 {
 			continue
 		}
-		lines = append(lines, line)
+		stmt := statement{text: line, file: filename, line: i + 1}
+		parts := strings.Fields(line)
+		if parts[0] != "include" {
+			lines = append(lines, stmt)
+			continue
+		}
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s: expected `include <path>`", stmt.pos())
+		}
+		// included files are resolved relative to the file including them
+		path := parts[1]
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(filename), path)
+		}
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("%s: could not include %s (%w)", stmt.pos(), parts[1], err)
+		}
+		if cycle := includeCycle(including, path); cycle != "" {
+			return nil, fmt.Errorf("%s: include cycle: %s", stmt.pos(), cycle)
+		}
+		included, err := readTestFile(path, including)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, included...)
 	}
-	return lines
+	return lines, nil
+}
+
+// includeCycle returns the chain of includes leading back to path, if including path would create a cycle
+func includeCycle(including []string, path string) string {
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	for i, file := range including {
+		if file != abspath {
+			continue
+		}
+		var chain []string
+		for _, f := range append(including[i:len(including):len(including)], abspath) {
+			chain = append(chain, filepath.Base(f))
+		}
+		return strings.Join(chain, " -> ")
+	}
+	return ""
 }
@@ -0,0 +1,47 @@
+// SPDX-FileCopyrightText: 2021 the netsim authors
+//
+// SPDX-License-Identifier: LGPL-3.0-or-later
+
+package sim
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIncludes(t *testing.T) {
+	a := assert.New(t)
+
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		a.NoError(os.MkdirAll(filepath.Dir(path), 0755))
+		a.NoError(os.WriteFile(path, []byte(contents), 0644))
+		return path
+	}
+	main := write("main.txt", "enter alice\n\ninclude parts/setup.txt\npost alice\n")
+	setup := write("parts/setup.txt", "start alice go-sbot\ninclude more/sync.txt\n")
+	sync := write("parts/more/sync.txt", "# included twice removed\nwaituntil alice alice@latest\n")
+
+	lines, err := readTestFile(main, nil)
+	a.NoError(err)
+	a.Equal([]statement{
+		{text: "enter alice", file: main, line: 1},
+		{text: "start alice go-sbot", file: setup, line: 1},
+		{text: "# included twice removed", file: sync, line: 1},
+		{text: "waituntil alice alice@latest", file: sync, line: 2},
+		{text: "post alice", file: main, line: 4},
+	}, lines)
+
+	cycleA := write("a.txt", "post alice\ninclude b.txt\n")
+	cycleB := write("b.txt", "include a.txt\n")
+	_, err = readTestFile(cycleA, nil)
+	a.EqualError(err, cycleB+":1: include cycle: a.txt -> b.txt -> a.txt")
+
+	write("missing.txt", "include nowhere.txt\n")
+	_, err = readTestFile(filepath.Join(dir, "missing.txt"), nil)
+	a.Error(err)
+}